@@ -2,12 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
-	"net/rpc"
 	"os"
 	"strconv"
 	"strings"
@@ -33,43 +33,36 @@ func main() {
 	rand.Seed(time.Now().UnixNano())
 
 	// Get the bind and connect connection strings from command-line arguments.
+	dataDir := flag.String("datadir", "", "directory to keep the routing table in across restarts")
+	paths := flag.Int("paths", 1, "number of disjoint paths each lookup follows")
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 2 {
-		log.Fatal("Must be invoked with exactly two arguments!\n")
+	if len(args) < 2 {
+		log.Fatal("Must be invoked with a listen address and at least one seed!\n")
 	}
 	listenStr := args[0]
-	firstPeerStr := args[1]
+	seeds := args[1:]
 
 	// Create the Kademlia instance
 	log.Println("Kademlia starting up!")
 	log.Println("Group: " + netIds + "\n")
 
-	kadem := libkademlia.NewKademlia(listenStr)
-
-	// Confirm our server is up with a PING request and then exit.
-	// Your code should loop forever, reading instructions from stdin and
-	// printing their results to stdout. See README.txt for more details.
-	_, port, err := net.SplitHostPort(firstPeerStr)
-	client, err := rpc.DialHTTPPath("tcp", firstPeerStr,
-		rpc.DefaultRPCPath+port)
+	kadem, err := libkademlia.NewKademliaWithConfig(listenStr, libkademlia.Config{DataDir: *dataDir, DisjointPaths: *paths})
 	if err != nil {
-		log.Fatal("DialHTTP: ", err)
+		log.Fatal(err)
 	}
 
-	log.Printf("Pinging initial peer\n")
-
-	// This is a sample of what an RPC looks like
-	// TODO: Replace this with a call to your completed DoPing!
-	ping := new(libkademlia.PingMessage)
-	ping.MsgID = libkademlia.NewRandomID()
-	var pong libkademlia.PongMessage
-	err = client.Call("KademliaRPC.Ping", ping, &pong)
+	// Join the network through whichever seeds are up. The first node of a
+	// network has nobody to join, which is not fatal.
+	log.Printf("Joining through %d seed(s)\n", len(seeds))
+	report, err := kadem.Join(seeds)
 	if err != nil {
-		log.Fatal("Call: ", err)
+		log.Println("Join: ", err)
+	}
+	for _, seed := range report.Unreachable {
+		log.Printf("Seed %s unreachable\n", seed)
 	}
-	log.Printf("ping msgID: %s\n", ping.MsgID.AsString())
-	log.Printf("pong msgID: %s\n\n", pong.MsgID.AsString())
+	log.Printf("Reached %d seed(s), learned %d contact(s)\n\n", report.SeedsReached, report.ContactsLearned)
 
 	in := bufio.NewReader(os.Stdin)
 	quit := false
@@ -90,6 +83,9 @@ func main() {
 			fmt.Printf("%v\n", resp)
 		}
 	}
+	if err := kadem.Close(); err != nil {
+		log.Println(err)
+	}
 }
 
 func executeLine(k *libkademlia.Kademlia, line string) (response string) {
@@ -207,8 +203,8 @@ func executeLine(k *libkademlia.Kademlia, line string) (response string) {
 
 	case toks[0] == "store":
 		// Store key, value pair at NodeID
-		if len(toks) < 4 || len(toks) > 4 {
-			response = "usage: store [nodeID] [key] [value]"
+		if len(toks) < 4 || len(toks) > 5 {
+			response = "usage: store [nodeID] [key] [value] [ttl]"
 			return
 		}
 		nodeId, err := libkademlia.IDFromString(toks[1])
@@ -227,8 +223,16 @@ func executeLine(k *libkademlia.Kademlia, line string) (response string) {
 			return
 		}
 		value := []byte(toks[3])
+		var ttl time.Duration
+		if len(toks) == 5 {
+			ttl, err = time.ParseDuration(toks[4])
+			if err != nil || ttl <= 0 {
+				response = "ERR: Provided an invalid TTL (" + toks[4] + ")"
+				return
+			}
+		}
 
-		err = k.DoStore(contact, key, value)
+		err = k.DoStoreTTL(contact, key, value, ttl)
 		if err != nil {
 			response = fmt.Sprintf("ERR: %s", err)
 		} else {
@@ -319,8 +323,8 @@ func executeLine(k *libkademlia.Kademlia, line string) (response string) {
 
 	case toks[0] == "iterativeStore":
 		// perform an iterative store
-		if len(toks) != 3 {
-			response = "usage: iterativeStore [key] [value]"
+		if len(toks) < 3 || len(toks) > 4 {
+			response = "usage: iterativeStore [key] [value] [ttl]"
 			return
 		}
 		key, err := libkademlia.IDFromString(toks[1])
@@ -328,7 +332,15 @@ func executeLine(k *libkademlia.Kademlia, line string) (response string) {
 			response = "ERR: Provided an invalid key (" + toks[1] + ")"
 			return
 		}
-		contacts, err := k.DoIterativeStore(key, []byte(toks[2]))
+		var ttl time.Duration
+		if len(toks) == 4 {
+			ttl, err = time.ParseDuration(toks[3])
+			if err != nil || ttl <= 0 {
+				response = "ERR: Provided an invalid TTL (" + toks[3] + ")"
+				return
+			}
+		}
+		contacts, err := k.DoIterativeStoreTTL(key, []byte(toks[2]), ttl)
 		if err != nil {
 			response = fmt.Sprintf("ERR: %s", err)
 		} else {
@@ -353,6 +365,67 @@ func executeLine(k *libkademlia.Kademlia, line string) (response string) {
 			response = fmt.Sprintf("OK: Found value %s", value)
 		}
 
+	case toks[0] == "storeContent":
+		// store a value under its content ID
+		if len(toks) != 2 {
+			response = "usage: storeContent [value]"
+			return
+		}
+		key, contacts, err := k.DoIterativeStoreContent([]byte(toks[1]))
+		if err != nil {
+			response = fmt.Sprintf("ERR: %s", err)
+		} else {
+			response = fmt.Sprintf("OK: Stored value under %s on %d contacts", key.AsString(), len(contacts))
+		}
+
+	case toks[0] == "findContent":
+		// find a value stored under its content ID and verify it
+		if len(toks) != 2 {
+			response = "usage: findContent [key]"
+			return
+		}
+		key, err := libkademlia.IDFromString(toks[1])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[1] + ")"
+			return
+		}
+		value, err := k.DoIterativeFindContent(key)
+		if err != nil {
+			response = fmt.Sprintf("ERR: %s", err)
+		} else {
+			response = fmt.Sprintf("OK: Found value %s", value)
+		}
+
+	case toks[0] == "trace":
+		// perform an iterative lookup and print what happened on the way
+		if len(toks) != 3 || (toks[1] != "iterativeFindNode" && toks[1] != "iterativeFindValue") {
+			response = "usage: trace [iterativeFindNode|iterativeFindValue] [key]"
+			return
+		}
+		key, err := libkademlia.IDFromString(toks[2])
+		if err != nil {
+			response = "ERR: Provided an invalid key (" + toks[2] + ")"
+			return
+		}
+		var trace *libkademlia.LookupTrace
+		if toks[1] == "iterativeFindNode" {
+			var contacts []libkademlia.Contact
+			contacts, trace, err = k.DoIterativeFindNodeTrace(context.Background(), key)
+			if err == nil {
+				response = fmt.Sprintf("OK: Got %d contacts\n", len(contacts))
+			}
+		} else {
+			var value []byte
+			value, trace, err = k.DoIterativeFindValueTrace(context.Background(), key)
+			if err == nil {
+				response = fmt.Sprintf("OK: Found value %s\n", value)
+			}
+		}
+		if err != nil {
+			response = fmt.Sprintf("ERR: %s\n", err)
+		}
+		response += trace.String()
+
 	default:
 		response = "ERR: Unknown command"
 	}
@@ -0,0 +1,156 @@
+package libkademlia
+
+// Contains the storage of values too large for a single STORE. A blob is
+// split into chunks stored under their content IDs, and a manifest listing
+// the chunks is stored under its own content ID, which names the blob.
+
+import (
+	"context"
+	"sync"
+)
+
+// BlobChunkSize is the size of every chunk of a blob but the last.
+const BlobChunkSize = 32 << 10
+
+// blobManifest lists the chunks of a blob in order.
+type blobManifest struct {
+	Size   int64
+	Chunks []ID
+}
+
+func (k *Kademlia) PutBlob(data []byte) (ID, error) {
+	return k.PutBlobContext(context.Background(), data)
+}
+
+// PutBlobContext stores data in chunks of BlobChunkSize bytes, each on the
+// K closest nodes to its content ID, then stores the manifest the same way.
+// It returns the content ID of the manifest, which GetBlob takes. As with
+// DoIterativeStore, the node republishes the chunks and the manifest, but it
+// keeps only the keys of the chunks and fetches them again to republish them.
+func (k *Kademlia) PutBlobContext(ctx context.Context, data []byte) (ID, error) {
+	var manifest blobManifest
+	manifest.Size = int64(len(data))
+	var chunks [][]byte
+	for start := 0; start < len(data); start += BlobChunkSize {
+		end := start + BlobChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[start:end])
+		manifest.Chunks = append(manifest.Chunks, ContentID(data[start:end], k.config.IDBits))
+	}
+	err := k.forEachChunk(ctx, len(chunks), func(ctx context.Context, i int) error {
+		k.publishKey(manifest.Chunks[i])
+		return k.storeBlobPart(ctx, manifest.Chunks[i], chunks[i])
+	})
+	if err != nil {
+		return ID{}, err
+	}
+	encoded, err := encodeMessage(&manifest)
+	if err != nil {
+		return ID{}, err
+	}
+	key := ContentID(encoded, k.config.IDBits)
+	k.publish(key, encoded, 0)
+	if err := k.storeBlobPart(ctx, key, encoded); err != nil {
+		return ID{}, err
+	}
+	return key, nil
+}
+
+// storeBlobPart stores a chunk or manifest without taking charge of
+// republishing it, failing unless some node took it.
+func (k *Kademlia) storeBlobPart(ctx context.Context, key ID, value []byte) error {
+	contacts, err := k.iterativeStore(ctx, key, value, 0)
+	if err == nil && len(contacts) == 0 {
+		err = &CommandFailed{"No node stored " + key.AsString()}
+	}
+	return err
+}
+
+func (k *Kademlia) GetBlob(key ID) ([]byte, error) {
+	return k.GetBlobContext(context.Background(), key)
+}
+
+// GetBlobContext finds the manifest stored under key and fetches its
+// chunks, Alpha at a time. Like DoIterativeFindContent, it skips nodes that
+// return a manifest or chunk not matching its content ID, and fails with a
+// *CorruptValueError if no node returns the right one. A manifest whose chunks
+// are not all BlobChunkSize bytes long but the last, which holds the rest of
+// the blob, is corrupt too.
+func (k *Kademlia) GetBlobContext(ctx context.Context, key ID) ([]byte, error) {
+	encoded, err := k.DoIterativeFindContentContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var manifest blobManifest
+	if decodeMessage(encoded, &manifest) != nil {
+		return nil, &CorruptValueError{key}
+	}
+	chunks := (manifest.Size + BlobChunkSize - 1) / BlobChunkSize
+	if manifest.Size < 0 || int64(len(manifest.Chunks)) != chunks {
+		return nil, &CorruptValueError{key}
+	}
+
+	data := make([]byte, manifest.Size)
+	err = k.forEachChunk(ctx, len(manifest.Chunks), func(ctx context.Context, i int) error {
+		chunkKey := manifest.Chunks[i]
+		chunk, err := k.DoIterativeFindContentContext(ctx, chunkKey)
+		if err != nil {
+			return err
+		}
+		start := i * BlobChunkSize
+		end := start + BlobChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if len(chunk) != end-start {
+			return &CorruptValueError{key}
+		}
+		copy(data[start:], chunk)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// forEachChunk calls fn for chunks 0 to n-1, Alpha at a time. It returns
+// the first error fn returns, once the calls still running have been
+// cancelled and have returned.
+func (k *Kademlia) forEachChunk(ctx context.Context, n int, fn func(ctx context.Context, i int) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	indices := make(chan int)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for w := 0; w < k.config.Alpha && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				if err := fn(ctx, i); err != nil {
+					errs <- err
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case indices <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indices)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
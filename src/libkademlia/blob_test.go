@@ -0,0 +1,168 @@
+package libkademlia
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBlob(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	r := rand.New(rand.NewSource(1))
+	for _, size := range []int{0, 100, 3*BlobChunkSize + 17} {
+		data := make([]byte, size)
+		r.Read(data)
+		key, err := nodes[0].PutBlob(data)
+		if err != nil {
+			t.Fatal("PutBlob Return Error: ", err)
+		}
+		got, err := nodes[7].GetBlob(key)
+		if err != nil {
+			t.Fatal("GetBlob Return Error: ", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("GetBlob returned different data for a blob of ", size, " bytes")
+		}
+	}
+}
+
+func TestBlobCorruptChunk(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	data := make([]byte, 2*BlobChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	key, err := nodes[0].PutBlob(data)
+	if err != nil {
+		t.Fatal("PutBlob Return Error: ", err)
+	}
+	encoded, err := nodes[0].DoIterativeFindValue(key)
+	if err != nil {
+		t.Fatal("Manifest not found: ", err)
+	}
+	var manifest blobManifest
+	if err := decodeMessage(encoded, &manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every node holding the second chunk swaps it for other bytes.
+	bad := manifest.Chunks[1]
+	for _, node := range nodes {
+		node.dataLock.Lock()
+		if value, ok, _ := node.store.Get(bad); ok {
+			value.Value = []byte("not the chunk")
+			node.store.Put(bad, value)
+		}
+		node.dataLock.Unlock()
+	}
+	_, err = nodes[7].GetBlob(key)
+	if corrupt, ok := err.(*CorruptValueError); !ok {
+		t.Error("Expected CorruptValueError, got ", err)
+	} else if !corrupt.Key.Equals(bad) {
+		t.Error("CorruptValueError names the wrong chunk")
+	}
+}
+
+func TestBlobChunksPublishedByKey(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	data := make([]byte, 2*BlobChunkSize+17)
+	rand.New(rand.NewSource(1)).Read(data)
+	key, err := nodes[0].PutBlob(data)
+	if err != nil {
+		t.Fatal("PutBlob Return Error: ", err)
+	}
+	encoded, err := nodes[0].DoIterativeFindValue(key)
+	if err != nil {
+		t.Fatal("Manifest not found: ", err)
+	}
+	var manifest blobManifest
+	if err := decodeMessage(encoded, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	nodes[0].publishLock.Lock()
+	for _, chunk := range manifest.Chunks {
+		if pv := nodes[0].published[chunk]; pv == nil || !pv.byKey || pv.value != nil {
+			t.Error("Chunk not published by key alone")
+		}
+	}
+	nodes[0].publishLock.Unlock()
+
+	// Every chunk is left on a single node.
+	holders := func(chunk ID) []*Kademlia {
+		var res []*Kademlia
+		for _, node := range nodes {
+			if _, err := node.LocalFindValue(chunk); err == nil {
+				res = append(res, node)
+			}
+		}
+		return res
+	}
+	for _, chunk := range manifest.Chunks {
+		for _, node := range holders(chunk)[1:] {
+			node.dataLock.Lock()
+			node.deleteStored(chunk)
+			node.dataLock.Unlock()
+		}
+	}
+	if n := nodes[0].republish(context.Background(), time.Now()); n != len(manifest.Chunks)+1 {
+		t.Error("Expected ", len(manifest.Chunks)+1, " values republished, got ", n)
+	}
+	for i, chunk := range manifest.Chunks {
+		if n := len(holders(chunk)); n < 2 {
+			t.Error("Chunk ", i, " held by ", n, " nodes after the republish")
+		}
+	}
+}
+
+func TestBlobShortChunk(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	// The first of two chunks is short, which would leave a gap of zeros
+	// in the blob.
+	var manifest blobManifest
+	manifest.Size = BlobChunkSize + 100
+	for _, chunk := range [][]byte{[]byte("first"), make([]byte, 100)} {
+		chunkKey, _, err := nodes[0].DoIterativeStoreContent(chunk)
+		if err != nil {
+			t.Fatal("DoIterativeStoreContent Return Error: ", err)
+		}
+		manifest.Chunks = append(manifest.Chunks, chunkKey)
+	}
+	encoded, err := encodeMessage(&manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := nodes[0].DoIterativeStoreContent(encoded)
+	if err != nil {
+		t.Fatal("DoIterativeStoreContent Return Error: ", err)
+	}
+	_, err = nodes[7].GetBlob(key)
+	if corrupt, ok := err.(*CorruptValueError); !ok {
+		t.Error("Expected CorruptValueError, got ", err)
+	} else if !corrupt.Key.Equals(key) {
+		t.Error("CorruptValueError does not name the manifest")
+	}
+}
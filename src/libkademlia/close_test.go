@@ -0,0 +1,60 @@
+package libkademlia
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCloseReleasesAddress(t *testing.T) {
+	instance1 := NewKademlia("localhost:9230")
+	defer instance1.Close()
+	host, port, _ := StringToIpPort("localhost:9231")
+	for i := 0; i < 3; i++ {
+		instance2 := NewKademlia("localhost:9231")
+		if _, err := instance1.DoPing(host, port); err != nil {
+			t.Error("Ping of restarted node failed: ", err)
+		}
+		if err := instance2.Close(); err != nil {
+			t.Error("Close failed: ", err)
+		}
+		if _, err := instance1.DoPing(host, port); err == nil {
+			t.Error("Ping of closed node succeeded")
+		}
+	}
+}
+
+func TestCloseUDP(t *testing.T) {
+	instance1 := NewKademliaWithTransport("localhost:9232", NewRandomID(), NewUDPTransport())
+	defer instance1.Close()
+	for i := 0; i < 2; i++ {
+		instance2 := NewKademliaWithTransport("localhost:9233", NewRandomID(), NewUDPTransport())
+		contact2 := instance2.SelfContact
+		if _, err := instance1.DoPing(contact2.Host, contact2.Port); err != nil {
+			t.Error("Ping of restarted UDP node failed: ", err)
+		}
+		instance2.Close()
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	network := NewSimNetwork(1)
+	before := runtime.NumGoroutine()
+	nodes := GenerateSimKademlia(network, 10, 1)
+	for _, node := range nodes {
+		node.Close()
+	}
+	// Calls on a closed node return instead of blocking on its handlers.
+	nodes[0].Update(nodes[1].SelfContact)
+	if _, err := nodes[0].LocalFindValue(NewRandomID()); err == nil {
+		t.Error("Closed node found a value")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Error("Goroutines leaked after Close: ", before, " before, ", after, " after")
+	}
+}
@@ -0,0 +1,156 @@
+package libkademlia
+
+// Contains the options a Kademlia node is created with.
+
+import (
+	"time"
+)
+
+const (
+	DefaultK                 = 20
+	DefaultAlpha             = 3
+	DefaultRefreshInterval   = time.Hour
+	DefaultSnapshotInterval  = 10 * time.Minute
+	DefaultValueTTL          = 24 * time.Hour
+	DefaultRepublishInterval = 23 * time.Hour
+	DefaultReplicateInterval = time.Hour
+)
+
+// Config holds the options for NewKademliaWithConfig. Fields left at their
+// zero value take the defaults described below.
+type Config struct {
+	// NodeID identifies the node. A random ID of IDBits bits is chosen if it
+	// is zero.
+	NodeID ID
+	// Transport carries the node's RPCs. Defaults to a new HTTPTransport.
+	Transport Transport
+	// K is the bucket size and the number of nodes a lookup returns and a
+	// value is stored on. Defaults to DefaultK.
+	K int
+	// Alpha is the number of RPCs a lookup has in flight at once. Defaults
+	// to DefaultAlpha.
+	Alpha int
+	// IDBits is the length of node IDs and keys, a multiple of 8 no larger
+	// than MaxIDBits. Defaults to IDBits. Every node of a network must use
+	// the same value. Up to IDBits, IDs travel in the original spec's
+	// 20-byte form, so such nodes can talk to nodes built from it.
+	IDBits int
+	// RefreshInterval is how long a bucket may go without a lookup before
+	// the node looks up a random ID in it. Defaults to
+	// DefaultRefreshInterval; a negative value turns refreshing off.
+	RefreshInterval time.Duration
+	// DataDir is where the node keeps a snapshot of its ID and routing
+	// table. If it holds one when the node starts, the node takes its ID
+	// from it (unless NodeID is set) and re-adds those of its contacts that
+	// still answer. No snapshot is kept if DataDir is empty.
+	DataDir string
+	// Store holds the values the node keeps for others. Defaults to a
+	// LogStore in DataDir if that is set, so the values outlive the node,
+	// and to a MemoryStore otherwise. The node closes it on Close.
+	Store Store
+	// SnapshotInterval is how often the snapshot is saved, besides on
+	// Close. Defaults to DefaultSnapshotInterval.
+	SnapshotInterval time.Duration
+	// DisjointPaths is the number of disjoint paths each lookup follows, as
+	// in S/Kademlia. No node is queried by more than one path, so a bad
+	// node can only mislead the path that reached it. Defaults to 1.
+	DisjointPaths int
+	// ValueTTL is how long the node keeps a value stored without a TTL,
+	// and the longest it keeps any value. Defaults to DefaultValueTTL.
+	ValueTTL time.Duration
+	// RepublishInterval is how often the node stores the values it
+	// published with DoIterativeStore again, for as long as their TTL
+	// lasts. Defaults to DefaultRepublishInterval, an hour short of
+	// DefaultValueTTL; a negative value turns republishing off.
+	RepublishInterval time.Duration
+	// ReplicateInterval is how often the node stores every value it holds
+	// on the K closest nodes to its key, skipping those it was sent during
+	// the last interval. Defaults to DefaultReplicateInterval; a negative
+	// value turns replication off.
+	ReplicateInterval time.Duration
+	// MaxStoreBytes, MaxValueSize and MaxSenderBytes limit the bytes of
+	// value the node holds for others in total, in any one value and from
+	// any one sender. Stores over a limit are refused with a
+	// *StoreRefusedError, except that Eviction may make room under
+	// MaxStoreBytes. Zero means no limit.
+	MaxStoreBytes  int64
+	MaxValueSize   int
+	MaxSenderBytes int64
+	// Eviction is the policy for making room under MaxStoreBytes. Defaults
+	// to EvictNone.
+	Eviction EvictionPolicy
+}
+
+// withDefaults returns a copy of config with unset fields filled in.
+func (config Config) withDefaults() Config {
+	if config.K == 0 {
+		config.K = DefaultK
+	}
+	if config.Alpha == 0 {
+		config.Alpha = DefaultAlpha
+	}
+	if config.IDBits == 0 {
+		config.IDBits = IDBits
+	}
+	if config.RefreshInterval == 0 {
+		config.RefreshInterval = DefaultRefreshInterval
+	}
+	if config.SnapshotInterval == 0 {
+		config.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if config.ValueTTL == 0 {
+		config.ValueTTL = DefaultValueTTL
+	}
+	if config.RepublishInterval == 0 {
+		config.RepublishInterval = DefaultRepublishInterval
+	}
+	if config.ReplicateInterval == 0 {
+		config.ReplicateInterval = DefaultReplicateInterval
+	}
+	if config.DisjointPaths == 0 {
+		config.DisjointPaths = 1
+	}
+	if config.NodeID == (ID{}) {
+		config.NodeID = NewRandomIDBits(config.IDBits)
+	}
+	if config.Transport == nil {
+		config.Transport = NewHTTPTransport()
+	}
+	return config
+}
+
+// validate checks the options of a config that has had its defaults filled
+// in.
+func (config Config) validate() error {
+	if config.K < 1 {
+		return &ConfigError{"K", config.K}
+	}
+	if config.Alpha < 1 {
+		return &ConfigError{"Alpha", config.Alpha}
+	}
+	if config.IDBits < 8 || config.IDBits > MaxIDBits || config.IDBits%8 != 0 {
+		return &ConfigError{"IDBits", config.IDBits}
+	}
+	if config.SnapshotInterval < 0 {
+		return &ConfigError{"SnapshotInterval", int(config.SnapshotInterval)}
+	}
+	if config.ValueTTL < 0 {
+		return &ConfigError{"ValueTTL", int(config.ValueTTL)}
+	}
+	if config.MaxStoreBytes < 0 {
+		return &ConfigError{"MaxStoreBytes", int(config.MaxStoreBytes)}
+	}
+	if config.MaxValueSize < 0 {
+		return &ConfigError{"MaxValueSize", config.MaxValueSize}
+	}
+	if config.MaxSenderBytes < 0 {
+		return &ConfigError{"MaxSenderBytes", int(config.MaxSenderBytes)}
+	}
+	if config.Eviction < EvictNone || config.Eviction > EvictLRU {
+		return &ConfigError{"Eviction", int(config.Eviction)}
+	}
+	if config.DisjointPaths < 1 {
+		return &ConfigError{"DisjointPaths", config.DisjointPaths}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package libkademlia
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+)
+
+// badHostTransport binds nothing and reports an address whose host cannot
+// be resolved.
+type badHostTransport struct{}
+
+func (badHostTransport) Listen(laddr string) (net.Addr, error) {
+	return &net.UnixAddr{Name: "bad_host!:9242", Net: "unix"}, nil
+}
+
+func (badHostTransport) Serve(server *rpc.Server) {
+}
+
+func (badHostTransport) Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	return errTransportClosed
+}
+
+func (badHostTransport) Close() error {
+	return nil
+}
+
+func TestConfigErrors(t *testing.T) {
+	if _, err := NewKademliaWithConfig("localhost", Config{}); err == nil {
+		t.Error("Missing port accepted")
+	} else if _, ok := err.(*AddressError); !ok {
+		t.Error("Expected AddressError, got ", err)
+	}
+
+	instance1, err := NewKademliaWithConfig("localhost:9240", Config{})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance1.Close()
+	if _, err := NewKademliaWithConfig("localhost:9240", Config{}); err == nil {
+		t.Error("Second node bound a port already in use")
+	} else if _, ok := err.(*BindError); !ok {
+		t.Error("Expected BindError, got ", err)
+	}
+
+	if _, err := NewKademliaWithConfig("localhost:9241", Config{IDBits: 100}); err == nil {
+		t.Error("IDBits not a multiple of 8 accepted")
+	} else if _, ok := err.(*ConfigError); !ok {
+		t.Error("Expected ConfigError, got ", err)
+	}
+
+	if _, err := NewKademliaWithConfig("localhost:9242", Config{Transport: badHostTransport{}}); err == nil {
+		t.Error("Unresolvable host accepted")
+	} else if _, ok := err.(*ResolveError); !ok {
+		t.Error("Expected ResolveError, got ", err)
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	id := NewRandomID()
+	network := NewSimNetwork(1)
+	instance1, err := NewKademliaWithConfig(SimAddress(0), Config{NodeID: id, Transport: network.Transport()})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance1.Close()
+	if !instance1.NodeID.Equals(id) || !instance1.SelfContact.NodeID.Equals(id) {
+		t.Error("Configured NodeID not used")
+	}
+	instance2, err := NewKademliaWithConfig(SimAddress(1), Config{Transport: network.Transport()})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance2.Close()
+	if instance2.NodeID.Equals(ID{}) {
+		t.Error("No random NodeID chosen")
+	}
+	contact2 := instance2.SelfContact
+	if _, err := instance1.DoPing(contact2.Host, contact2.Port); err != nil {
+		t.Error("Ping over configured transport failed: ", err)
+	}
+}
+
+func TestConfigSmallKLongIDs(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := make([]*Kademlia, 0, 60)
+	for i := 0; i < 60; i++ {
+		config := Config{Transport: network.Transport(), K: 4, Alpha: 2, IDBits: 256}
+		instance, err := NewKademliaWithConfig(SimAddress(i), config)
+		if err != nil {
+			t.Fatal("NewKademliaWithConfig failed: ", err)
+		}
+		defer instance.Close()
+		if i > 0 {
+			peer := nodes[i-1].SelfContact
+			instance.DoPing(peer.Host, peer.Port)
+			instance.DoIterativeFindNode(instance.NodeID)
+		}
+		nodes = append(nodes, instance)
+	}
+	if len(nodes[0].NodeID.AsString()) != 2*MaxIDBytes {
+		t.Error("Expected a 256-bit ID, got ", nodes[0].NodeID.AsString())
+	}
+	for _, node := range nodes {
+		for i, kb := range node.copyTable() {
+			if len(kb) > 4 {
+				t.Error("Bucket ", i, " holds ", len(kb), " contacts")
+			}
+		}
+	}
+	for i := 0; i < 10; i++ {
+		from := nodes[i]
+		target := nodes[59-i]
+		contacts, err := from.DoIterativeFindNode(target.NodeID)
+		if err != nil {
+			t.Error("DoIterativeFindNode Return Error: ", err)
+			continue
+		}
+		if len(contacts) == 0 || len(contacts) > 4 {
+			t.Error("Lookup returned ", len(contacts), " contacts")
+		}
+	}
+}
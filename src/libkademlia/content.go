@@ -0,0 +1,43 @@
+package libkademlia
+
+// Contains the content-addressed mode of storage, where a value's key is its
+// content ID, so that whoever looks a value up can tell whether a node handed
+// back the real thing.
+
+import (
+	"context"
+)
+
+func (k *Kademlia) DoIterativeStoreContent(value []byte) (ID, []Contact, error) {
+	return k.DoIterativeStoreContentContext(context.Background(), value)
+}
+
+// DoIterativeStoreContentContext stores value under its content ID, which
+// it returns along with the nodes that took the value.
+func (k *Kademlia) DoIterativeStoreContentContext(ctx context.Context, value []byte) (ID, []Contact, error) {
+	key := ContentID(value, k.config.IDBits)
+	contacts, err := k.DoIterativeStoreContext(ctx, key, value)
+	return key, contacts, err
+}
+
+func (k *Kademlia) DoIterativeFindContent(key ID) ([]byte, error) {
+	return k.DoIterativeFindContentContext(context.Background(), key)
+}
+
+// DoIterativeFindContentContext is DoIterativeFindValueContext for a value
+// stored under its content ID. Values that do not match key are discarded
+// and the nodes that returned them dropped from the routing table. If no
+// node returns the right value and some returned another, it fails with a
+// *CorruptValueError.
+func (k *Kademlia) DoIterativeFindContentContext(ctx context.Context, key ID) ([]byte, error) {
+	return k.iterativeFindValue(ctx, key, true, nil)
+}
+
+// penalize drops a contact that answered with corrupt data from the routing
+// table.
+func (k *Kademlia) penalize(contact *Contact) {
+	select {
+	case k.channel.contactStatusChan <- contactStatus{*contact, false, true}:
+	case <-k.channel.done:
+	}
+}
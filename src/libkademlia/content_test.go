@@ -0,0 +1,114 @@
+package libkademlia
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestContent(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	value := []byte("content-addressed value")
+	key, contacts, err := nodes[0].DoIterativeStoreContent(value)
+	if err != nil {
+		t.Fatal("DoIterativeStoreContent Return Error: ", err)
+	}
+	if !key.Equals(ContentID(value, nodes[0].config.IDBits)) {
+		t.Error("Value not stored under its content ID")
+	}
+	if len(contacts) == 0 {
+		t.Error("No node stored the value")
+	}
+	got, err := nodes[7].DoIterativeFindContent(key)
+	if err != nil {
+		t.Fatal("DoIterativeFindContent Return Error: ", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Error("DoIterativeFindContent returned a different value")
+	}
+}
+
+func TestContentCorrupt(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	value := []byte("content-addressed value")
+	key, _, err := nodes[0].DoIterativeStoreContent(value)
+	if err != nil {
+		t.Fatal("DoIterativeStoreContent Return Error: ", err)
+	}
+	finder := nodes[7]
+	tamper := func(node *Kademlia) bool {
+		node.dataLock.Lock()
+		defer node.dataLock.Unlock()
+		stored, ok, _ := node.store.Get(key)
+		if ok {
+			stored.Value = []byte("not the value")
+			node.store.Put(key, stored)
+		}
+		return ok
+	}
+
+	// Every holder but the one farthest from the key swaps the value for
+	// other bytes, so the lookup meets bad copies before the good one.
+	var good *Kademlia
+	for _, node := range nodes {
+		if node == finder {
+			continue
+		}
+		if _, ok := node.storedValue(key); !ok {
+			continue
+		}
+		if good == nil || key.DistanceTo(good.NodeID).Less(key.DistanceTo(node.NodeID)) {
+			good = node
+		}
+	}
+	if good == nil {
+		t.Fatal("No node holds the value")
+	}
+	var tampered []*Kademlia
+	for _, node := range nodes {
+		if node != good && node != finder && tamper(node) {
+			tampered = append(tampered, node)
+		}
+	}
+	got, err := finder.DoIterativeFindContent(key)
+	if err != nil {
+		t.Fatal("DoIterativeFindContent Return Error: ", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Error("DoIterativeFindContent returned a corrupt value")
+	}
+	if _, err := finder.FindContact(good.NodeID); err != nil {
+		t.Error("Node with the right value was dropped from the routing table")
+	}
+	dropped := 0
+	for _, node := range tampered {
+		if _, err := finder.FindContact(node.NodeID); err != nil {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Error("No node returning a corrupt value was dropped from the routing table")
+	}
+
+	// With no good copy left, including the one the lookup cached, it
+	// reports the corruption.
+	for _, node := range nodes {
+		tamper(node)
+	}
+	if _, err := nodes[2].DoIterativeFindContent(key); err == nil {
+		t.Error("DoIterativeFindContent returned a corrupt value")
+	} else if _, ok := err.(*CorruptValueError); !ok {
+		t.Error("Expected CorruptValueError, got ", err)
+	}
+}
@@ -0,0 +1,82 @@
+package libkademlia
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPingDeadlineOnStalledPeer(t *testing.T) {
+	instance1 := NewKademlia("localhost:9220")
+	// Accepts connections but never answers the HTTP handshake.
+	l, err := net.Listen("tcp", "localhost:9221")
+	if err != nil {
+		t.Error("Listen: ", err)
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	host, port, _ := StringToIpPort("localhost:9221")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := instance1.DoPingContext(ctx, host, port); err == nil {
+		t.Error("Ping of a stalled peer succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Ping ignored its deadline: ", elapsed)
+	}
+}
+
+func TestContextCancelsRPC(t *testing.T) {
+	network := NewSimNetwork(1)
+	instance1 := NewKademliaWithTransport(SimAddress(0), NewRandomID(), network.Transport())
+	instance2 := NewKademliaWithTransport(SimAddress(1), NewRandomID(), network.Transport())
+	defer closeAll([]*Kademlia{instance1, instance2})
+	network.SetLatency(time.Second, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := instance1.DoPingContext(ctx, instance2.SelfContact.Host, instance2.SelfContact.Port)
+	if err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded, got ", err)
+	}
+	err = instance1.DoStoreContext(ctx, &instance2.SelfContact, NewRandomID(), []byte("x"))
+	if err != context.DeadlineExceeded {
+		t.Error("Expected DeadlineExceeded from store, got ", err)
+	}
+}
+
+func TestContextAbortsIterativeLookup(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 30, 1)
+	defer closeAll(nodes)
+	network.SetLatency(time.Second, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start := time.Now()
+	_, err := nodes[0].DoIterativeFindNodeContext(ctx, NewRandomID())
+	if err != context.Canceled {
+		t.Error("Expected Canceled, got ", err)
+	}
+	_, err = nodes[0].DoIterativeFindValueContext(ctx, NewRandomID())
+	if err != context.Canceled {
+		t.Error("Expected Canceled from find value, got ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Error("Lookup kept running after cancel: ", elapsed)
+	}
+}
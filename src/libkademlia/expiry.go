@@ -0,0 +1,47 @@
+package libkademlia
+
+// Contains the sweeper that deletes stored values once they expire.
+
+import (
+	"time"
+)
+
+// expirySweepInterval is how often expired values are deleted. Lookups
+// ignore expired values whether or not they have been deleted yet.
+const expirySweepInterval = time.Minute
+
+// HandleExpiry deletes expired values every expirySweepInterval until the
+// node is closed.
+func (k *Kademlia) HandleExpiry() {
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			k.expireData(now)
+		case <-k.channel.done:
+			return
+		}
+	}
+}
+
+// expireData deletes the values that expire before now and returns how many
+// it deleted.
+func (k *Kademlia) expireData(now time.Time) int {
+	k.dataLock.Lock()
+	defer k.dataLock.Unlock()
+	var expired []ID
+	k.store.Iterate(func(key ID, value StoredValue) bool {
+		if !now.Before(value.Expires) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+	deleted := 0
+	for _, key := range expired {
+		if k.deleteStored(key) == nil {
+			deleted++
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,70 @@
+package libkademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestValueExpires(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 2, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	contact := nodes[1].SelfContact
+	short, long := NewRandomID(), NewRandomID()
+	if err := nodes[0].DoStoreTTL(&contact, short, []byte("short"), 100*time.Millisecond); err != nil {
+		t.Fatal("DoStoreTTL Return Error: ", err)
+	}
+	if err := nodes[0].DoStore(&contact, long, []byte("long")); err != nil {
+		t.Fatal("DoStore Return Error: ", err)
+	}
+	if _, err := nodes[1].LocalFindValue(short); err != nil {
+		t.Error("Value missing before its TTL ran out")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := nodes[1].LocalFindValue(short); err == nil {
+		t.Error("Expired value still found")
+	}
+	if value, _, _ := nodes[0].DoFindValue(&contact, short); value != nil {
+		t.Error("Expired value returned by FindValue")
+	}
+	if n := nodes[1].expireData(time.Now()); n != 1 {
+		t.Error("Expected 1 value swept, got ", n)
+	}
+	if _, err := nodes[1].LocalFindValue(long); err != nil {
+		t.Error("Value stored without a TTL expired")
+	}
+
+	if err := nodes[0].DoStoreTTL(&contact, short, []byte("short"), -time.Second); err == nil {
+		t.Error("Negative TTL accepted")
+	}
+}
+
+func TestValueTTLCapped(t *testing.T) {
+	network := NewSimNetwork(1)
+	config := Config{Transport: network.Transport(), ValueTTL: time.Hour}
+	node, err := NewKademliaWithConfig(SimAddress(1), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	other := GenerateSimKademlia(network, 1, 2)[0]
+	defer other.Close()
+
+	key := NewRandomID()
+	if err := other.DoStoreTTL(&node.SelfContact, key, []byte("value"), 48*time.Hour); err != nil {
+		t.Fatal("DoStoreTTL Return Error: ", err)
+	}
+	_, ttl, _, err := other.findValue(context.Background(), &node.SelfContact, key)
+	if err != nil {
+		t.Fatal("FindValue Return Error: ", err)
+	}
+	if ttl <= 0 || ttl > time.Hour {
+		t.Error("Expected the TTL to be capped at an hour, got ", ttl)
+	}
+}
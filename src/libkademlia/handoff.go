@@ -0,0 +1,99 @@
+package libkademlia
+
+// Contains the hand-off of stored values to nodes that join close to their
+// keys, as described in section 2.5 of the Kademlia paper.
+
+import (
+	"time"
+)
+
+// handOffQueueSize is how many newcomers may wait for HandleHandOff. A
+// newcomer arriving while the queue is full is not handed anything; it gets
+// the values it should hold from the next replication.
+const handOffQueueSize = 64
+
+// queueHandOff queues a contact that just entered the routing table for
+// HandleHandOff without blocking.
+func (k *Kademlia) queueHandOff(newcomer Contact) {
+	select {
+	case k.channel.handOffChan <- newcomer:
+	default:
+	}
+}
+
+// HandleHandOff hands stored values off to the queued newcomers, taking
+// every newcomer queued by then in one pass so that a burst of them costs
+// one walk over the stored keys.
+func (k *Kademlia) HandleHandOff() {
+	for {
+		select {
+		case newcomer := <-k.channel.handOffChan:
+			newcomers := []Contact{newcomer}
+		drain:
+			for {
+				select {
+				case newcomer := <-k.channel.handOffChan:
+					newcomers = append(newcomers, newcomer)
+				default:
+					break drain
+				}
+			}
+			k.handOff(newcomers)
+		case <-k.channel.done:
+			return
+		}
+	}
+}
+
+// handOff stores on each newcomer every value for which it is among the K
+// closest nodes we know of. Of the nodes holding a value, only the closest to
+// its key sends it, which saves the newcomer from receiving it K times over;
+// the decision is made from our routing table alone, taking any node we know
+// closer to the key than us to hold the value too.
+func (k *Kademlia) handOff(newcomers []Contact) {
+	now := time.Now()
+	keys := k.storedKeys(func(value StoredValue) bool {
+		return now.Before(value.Expires)
+	})
+	if len(keys) == 0 {
+		return
+	}
+	table := k.copyTable()
+	contacts := table.GetContacts()
+	for _, key := range keys {
+		for i := range newcomers {
+			if k.ctx.Err() != nil {
+				return
+			}
+			if !k.shouldHandOff(key, newcomers[i], contacts) {
+				continue
+			}
+			value, ok := k.storedValue(key)
+			if ttl := value.Expires.Sub(time.Now()); ok && ttl > 0 {
+				k.DoStoreTTLContext(k.ctx, &newcomers[i], key, value.Value, ttl)
+			}
+		}
+	}
+}
+
+// shouldHandOff reports whether, going by contacts, newcomer is closer to key
+// than the K'th closest of the other contacts and none of them is closer to
+// key than we are.
+func (k *Kademlia) shouldHandOff(key ID, newcomer Contact, contacts []Contact) bool {
+	own := key.DistanceTo(k.NodeID)
+	theirs := key.DistanceTo(newcomer.NodeID)
+	closer := 0
+	for _, c := range contacts {
+		if c.NodeID.Equals(newcomer.NodeID) {
+			continue
+		}
+		d := key.DistanceTo(c.NodeID)
+		if d.Less(own) {
+			return false
+		}
+		if d.Less(theirs) {
+			closer++
+		}
+	}
+	return closer < k.config.K
+}
@@ -0,0 +1,127 @@
+package libkademlia
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// waitForValue polls a node for key until it has it or timeout passes.
+func waitForValue(k *Kademlia, key ID, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := k.LocalFindValue(key); err == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandOffToCloserNode(t *testing.T) {
+	network := NewSimNetwork(1)
+	// The IDs differ in their top four bits, so with buckets of 8 every
+	// node knows every other one: the value reaches the K closest nodes to
+	// its key, and the closest of them knows of no node closer still.
+	r := rand.New(rand.NewSource(1))
+	nodes := make([]*Kademlia, 16)
+	for i := range nodes {
+		var id ID
+		r.Read(id[:IDBytes])
+		id[0] = id[0]&0x0f | byte(i<<4)
+		config := Config{NodeID: id, Transport: network.Transport(), K: 8, Alpha: 2}
+		node, err := NewKademliaWithConfig(SimAddress(i), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	for i, node := range nodes {
+		for _, other := range nodes[i+1:] {
+			if _, err := node.DoPing(other.SelfContact.Host, other.SelfContact.Port); err != nil {
+				t.Fatal("DoPing Return Error: ", err)
+			}
+		}
+	}
+	var key ID
+	r.Read(key[:IDBytes])
+	// An iterative store skips the node running it, so that node must not
+	// be the closest to the key: store from the farthest.
+	from := nodes[key[0]>>4^0x0f]
+	if _, err := from.DoIterativeStore(key, []byte("value")); err != nil {
+		t.Fatal("DoIterativeStore Return Error: ", err)
+	}
+
+	join := func(i int, id ID) *Kademlia {
+		config := Config{NodeID: id, Transport: network.Transport(), K: 8, Alpha: 2}
+		node, err := NewKademliaWithConfig(SimAddress(i), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := node.Join([]string{SimAddress(0)}); err != nil {
+			t.Fatal("Join Return Error: ", err)
+		}
+		return node
+	}
+	var far ID
+	for i := 0; i < IDBytes; i++ {
+		far[i] = ^key[i]
+	}
+	closer := join(len(nodes), key)
+	defer closer.Close()
+	farther := join(len(nodes)+1, far)
+	defer farther.Close()
+
+	if !waitForValue(closer, key, 2*time.Second) {
+		t.Error("Value not handed off to a node that joined next to its key")
+	}
+	if waitForValue(farther, key, 200*time.Millisecond) {
+		t.Error("Value handed off to a node far from its key")
+	}
+	if value, err := closer.DoIterativeFindValue(key); err != nil || string(value) != "value" {
+		t.Error("Value not found after the hand-off: ", err)
+	}
+}
+
+func TestShouldHandOff(t *testing.T) {
+	// The key is the zero ID, so an ID's first byte orders it by distance.
+	id := func(b byte) ID {
+		var id ID
+		id[0] = b
+		return id
+	}
+	contacts := func(bs ...byte) []Contact {
+		var res []Contact
+		for _, b := range bs {
+			res = append(res, Contact{NodeID: id(b)})
+		}
+		return res
+	}
+	k := &Kademlia{NodeID: id(0x10), config: Config{K: 2}}
+	var key ID
+	cases := []struct {
+		newcomer byte
+		contacts []Contact
+		want     bool
+	}{
+		{0x20, contacts(0x30, 0x40), true},
+		{0x08, contacts(0x30, 0x40), true},
+		{0x50, contacts(0x30), true},
+		{0x50, contacts(0x30, 0x40), false},
+		{0x20, contacts(0x08, 0x40), false},
+		// The newcomer may already be in the table.
+		{0x20, contacts(0x20, 0x30), true},
+	}
+	for _, c := range cases {
+		if got := k.shouldHandOff(key, Contact{NodeID: id(c.newcomer)}, c.contacts); got != c.want {
+			t.Errorf("shouldHandOff(%#x, %v) = %v, want %v", c.newcomer, c.contacts, got, c.want)
+		}
+	}
+}
@@ -1,26 +1,40 @@
 package libkademlia
 
-// Contains definitions for the 160-bit identifiers used throughout kademlia.
+// Contains definitions for the identifiers used throughout kademlia. IDs are
+// 160 bits by default; a node can be configured to use up to 256.
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"math/rand"
 )
 
-// IDs are 160-bit ints. We're going to use byte arrays with a number of
-// methods.
+// IDs are ints of up to 256 bits. We're going to use byte arrays with a
+// number of methods. IDs shorter than MaxIDBytes leave the trailing bytes
+// zero.
 const IDBytes = 20
 const IDBits = IDBytes * 8
+const MaxIDBytes = 32
+const MaxIDBits = MaxIDBytes * 8
 
-type ID [IDBytes]byte
+type ID [MaxIDBytes]byte
 
+// AsString returns the ID in hex. IDs whose bytes past IDBytes are all zero
+// print as IDBytes bytes.
 func (id ID) AsString() string {
-	return hex.EncodeToString(id[0:IDBytes])
+	n := MaxIDBytes
+	for n > IDBytes && id[n-1] == 0 {
+		n--
+	}
+	if n > IDBytes {
+		n = MaxIDBytes
+	}
+	return hex.EncodeToString(id[0:n])
 }
 
 func (id ID) Xor(other ID) (ret ID) {
-	for i := 0; i < IDBytes; i++ {
+	for i := 0; i < MaxIDBytes; i++ {
 		ret[i] = id[i] ^ other[i]
 	}
 	return
@@ -28,7 +42,7 @@ func (id ID) Xor(other ID) (ret ID) {
 
 // Return -1, 0, or 1, with the same meaning as strcmp, etc.
 func (id ID) Compare(other ID) int {
-	for i := 0; i < IDBytes; i++ {
+	for i := 0; i < MaxIDBytes; i++ {
 		difference := int(id[i]) - int(other[i])
 		switch {
 		case difference == 0:
@@ -50,21 +64,51 @@ func (id ID) Less(other ID) bool {
 	return id.Compare(other) < 0
 }
 
+// A Distance is the XOR of two IDs, compared as an unsigned integer.
+type Distance ID
+
+// MaxDistance is greater than the distance between any two IDs of less than
+// MaxIDBits bits.
+var MaxDistance = func() (d Distance) {
+	for i := range d {
+		d[i] = 0xff
+	}
+	return
+}()
+
+func (id ID) DistanceTo(other ID) Distance {
+	return Distance(id.Xor(other))
+}
+
+func (d Distance) Compare(other Distance) int {
+	return ID(d).Compare(ID(other))
+}
+
+func (d Distance) Less(other Distance) bool {
+	return d.Compare(other) < 0
+}
+
 // Return the number of consecutive zeroes in an ID
 func (id ID) PrefixLen() int {
-	for i := 0; i < IDBytes; i++ {
+	for i := 0; i < MaxIDBytes; i++ {
 		for j := 7; j >= 0; j-- {
 			if (id[i]>>uint8(j))&0x1 != 0 {
 				return (8 * i) + (7 - j)
 			}
 		}
 	}
-	return IDBytes*8 - 1
+	return MaxIDBits - 1
 }
 
 // Generate a new ID from nothing.
 func NewRandomID() (ret ID) {
-	for i := 0; i < IDBytes; i++ {
+	return NewRandomIDBits(IDBits)
+}
+
+// Generate a new ID of the given number of bits, which must be a multiple of
+// 8 no larger than MaxIDBits.
+func NewRandomIDBits(bits int) (ret ID) {
+	for i := 0; i < bits/8; i++ {
 		ret[i] = uint8(rand.Intn(256))
 	}
 	return
@@ -72,7 +116,7 @@ func NewRandomID() (ret ID) {
 
 // Generate an ID identical to another.
 func CopyID(id ID) (ret ID) {
-	for i := 0; i < IDBytes; i++ {
+	for i := 0; i < MaxIDBytes; i++ {
 		ret[i] = id[i]
 	}
 	return
@@ -85,7 +129,7 @@ func IDFromString(idstr string) (ret ID, err error) {
 		return
 	}
 
-	for i := 0; i < IDBytes && i < len(bytes); i++ {
+	for i := 0; i < MaxIDBytes && i < len(bytes); i++ {
 		ret[i] = bytes[i]
 	}
 	return
@@ -94,3 +138,12 @@ func IDFromString(idstr string) (ret ID, err error) {
 func Checksum(data []byte) [16]byte {
 	return md5.Sum(data)
 }
+
+// ContentID returns an ID of the given number of bits taken from the
+// SHA-256 hash of data, so that anyone holding data can check it against
+// the ID.
+func ContentID(data []byte, bits int) (ret ID) {
+	sum := sha256.Sum256(data)
+	copy(ret[:bits/8], sum[:])
+	return
+}
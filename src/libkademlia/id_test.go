@@ -71,3 +71,39 @@ func TestCompare(t *testing.T) {
 	}
 	return
 }
+
+func TestDistance(t *testing.T) {
+	var id1, id2, id3 ID
+	id2[0] = 0x01
+	id3[IDBytes-1] = 0xff
+	// id3 differs from id1 in more bits, but only in less significant ones.
+	if !id1.DistanceTo(id3).Less(id1.DistanceTo(id2)) {
+		t.Error("Distance ordered by bit count instead of value")
+	}
+	if id1.DistanceTo(id2).Compare(id2.DistanceTo(id1)) != 0 {
+		t.Error("Distance not symmetric")
+	}
+	if id1.DistanceTo(id1).Compare(Distance{}) != 0 {
+		t.Error("Distance to self not zero")
+	}
+	for i := 0; i < 100; i++ {
+		if !NewRandomID().DistanceTo(NewRandomID()).Less(MaxDistance) {
+			t.Error("Distance not below MaxDistance")
+		}
+	}
+}
+
+func TestContentID(t *testing.T) {
+	id := ContentID([]byte("value"), IDBits)
+	if !id.Equals(ContentID([]byte("value"), IDBits)) {
+		t.Error("ContentID not deterministic")
+	}
+	if id.Equals(ContentID([]byte("other"), IDBits)) {
+		t.Error("Different values share a ContentID")
+	}
+	for i := IDBytes; i < MaxIDBytes; i++ {
+		if id[i] != 0 {
+			t.Error("ContentID longer than the bits asked for")
+		}
+	}
+}
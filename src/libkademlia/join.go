@@ -0,0 +1,90 @@
+package libkademlia
+
+// Contains the procedure a node follows to join the network, as described in
+// section 2.3 of the Kademlia paper.
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// JoinReport describes the outcome of Join.
+type JoinReport struct {
+	// SeedsReached is the number of seeds that answered a ping.
+	SeedsReached int
+	// Unreachable lists the seeds that could not be pinged.
+	Unreachable []string
+	// ContactsLearned is the number of contacts the routing table gained.
+	ContactsLearned int
+}
+
+func (k *Kademlia) Join(seeds []string) (JoinReport, error) {
+	return k.JoinContext(context.Background(), seeds)
+}
+
+// JoinContext pings each of the seeds, given as host:port, looks up the
+// node's own ID and then refreshes every bucket further away than its
+// closest neighbour. It fails if none of the seeds answer and the routing
+// table is empty, e.g. because no snapshot was restored.
+func (k *Kademlia) JoinContext(ctx context.Context, seeds []string) (report JoinReport, err error) {
+	before := countTableContacts(k.copyTable())
+	for _, seed := range seeds {
+		if err = k.pingSeed(ctx, seed); err != nil {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			report.Unreachable = append(report.Unreachable, seed)
+			continue
+		}
+		report.SeedsReached++
+	}
+	if before == 0 && countTableContacts(k.copyTable()) == 0 {
+		return report, &CommandFailed{"Unable to reach any seed"}
+	}
+
+	if _, err = k.DoIterativeFindNodeContext(ctx, k.NodeID); err != nil {
+		return report, err
+	}
+	table := k.copyTable()
+	closest := 0
+	for closest < k.config.IDBits-1 && len(table[closest]) == 0 {
+		closest++
+	}
+	for i := closest + 1; i < k.config.IDBits; i++ {
+		if _, err = k.DoIterativeFindNodeContext(ctx, k.RandomIDInBucket(i)); err != nil {
+			return report, err
+		}
+	}
+	report.ContactsLearned = countTableContacts(k.copyTable()) - before
+	return report, nil
+}
+
+// pingSeed pings a seed given as host:port. A seed that turns out to be this
+// node counts as unreachable.
+func (k *Kademlia) pingSeed(ctx context.Context, seed string) error {
+	hostname, portstr, err := net.SplitHostPort(seed)
+	if err != nil {
+		return &AddressError{seed, err}
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return &AddressError{seed, err}
+	}
+	host, err := resolveHost(hostname)
+	if err != nil {
+		return err
+	}
+	contact, err := k.DoPingContext(ctx, host, uint16(port))
+	if err != nil {
+		return err
+	}
+	if contact.NodeID.Equals(k.NodeID) {
+		return &CommandFailed{"Seed " + seed + " is this node"}
+	}
+	return nil
+}
+
+func countTableContacts(table RoutingTable) int {
+	return len(table.GetContacts())
+}
@@ -0,0 +1,69 @@
+package libkademlia
+
+import (
+	"testing"
+)
+
+func TestJoin(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 40, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+
+	instance1, err := NewKademliaWithConfig(SimAddress(40), Config{Transport: network.Transport()})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance1.Close()
+	seeds := []string{SimAddress(0), SimAddress(41), SimAddress(5)}
+	report, err := instance1.Join(seeds)
+	if err != nil {
+		t.Fatal("Join failed: ", err)
+	}
+	if report.SeedsReached != 2 {
+		t.Error("Expected 2 seeds reached, got ", report.SeedsReached)
+	}
+	if len(report.Unreachable) != 1 || report.Unreachable[0] != SimAddress(41) {
+		t.Error("Expected ", SimAddress(41), " unreachable, got ", report.Unreachable)
+	}
+	if report.ContactsLearned < 20 {
+		t.Error("Join learned only ", report.ContactsLearned, " contacts")
+	}
+	if n := countTableContacts(instance1.copyTable()); n != report.ContactsLearned {
+		t.Error("Report says ", report.ContactsLearned, " contacts learned, table has ", n)
+	}
+
+	// The joined node is now known to the nodes closest to it.
+	contacts, err := nodes[10].DoIterativeFindNode(instance1.NodeID)
+	if err != nil {
+		t.Fatal("DoIterativeFindNode Return Error: ", err)
+	}
+	found := false
+	for _, c := range contacts {
+		if c.NodeID.Equals(instance1.NodeID) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Joined node not found by lookup")
+	}
+}
+
+func TestJoinNoSeeds(t *testing.T) {
+	network := NewSimNetwork(1)
+	instance1, err := NewKademliaWithConfig(SimAddress(0), Config{Transport: network.Transport()})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance1.Close()
+	report, err := instance1.Join([]string{SimAddress(0), SimAddress(1), "bad address"})
+	if err == nil {
+		t.Error("Join succeeded without any seed")
+	}
+	if report.SeedsReached != 0 || len(report.Unreachable) != 3 {
+		t.Error("Unexpected report: ", report)
+	}
+}
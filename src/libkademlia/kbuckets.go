@@ -2,13 +2,21 @@ package libkademlia
 
 // Contains definitions for the RoutingTable and K-Bucket.
 
+// A contact that fails this many RPCs in a row is dropped from the routing
+// table in favour of one from the replacement cache.
+const staleFailures = 3
+
 type KBucket []Contact
 
-type RoutingTable [IDBits]KBucket
+// A RoutingTable has room for the largest ID size; a node only uses the
+// first IDBits buckets of its configuration.
+type RoutingTable [MaxIDBits]KBucket
 
+// Initialize empties every bucket. Buckets grow as contacts are added, so
+// the unused ones cost nothing.
 func (table *RoutingTable) Initialize() {
-	for i := 0; i < IDBits; i++ {
-		table[i] = make([]Contact, 0, k)
+	for i := 0; i < MaxIDBits; i++ {
+		table[i] = make([]Contact, 0)
 	}
 }
 
@@ -68,3 +76,15 @@ func (kb *KBucket) MoveToTail(i int) {
 	kb.Remove(i)
 	kb.AddToTail(c)
 }
+
+// AddReplacement records c as the most recently seen contact of a
+// replacement cache holding at most size contacts.
+func (kb *KBucket) AddReplacement(c Contact, size int) {
+	if contains, i := kb.FindContactInKBucket(c); contains {
+		kb.Remove(i)
+	}
+	if len(*kb) >= size {
+		kb.Remove(0)
+	}
+	kb.AddToTail(c)
+}
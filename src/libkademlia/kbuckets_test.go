@@ -6,7 +6,9 @@ package libkademlia
 import (
 	"fmt"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestRemove(t *testing.T) {
@@ -23,7 +25,7 @@ func TestRemove(t *testing.T) {
 		t.Error("Cannot find remote's contact.")
 	}
 	selfkbindex := k.FindBucket(remoteID)
-	fmt.Printf("%s", selfkbindex)
+	fmt.Printf("%d", selfkbindex)
 	kb := &k.table[selfkbindex]
 	contains_1, i := kb.FindContactInKBucket(c)
 	if !contains_1 {
@@ -49,7 +51,7 @@ func TestMoveToTail(t *testing.T) {
 		t.Error("Cannot find remote's contact.")
 	}
 	selfkbindex := k.FindBucket(remoteID)
-	fmt.Printf("%s", selfkbindex)
+	fmt.Printf("%d", selfkbindex)
 	kb := &k.table[selfkbindex]
 	contains, i := kb.FindContactInKBucket(c)
 	if !contains {
@@ -81,7 +83,7 @@ func TestAddToTail(t *testing.T) {
 		t.Error("Cannot find remote's contact.")
 	}
 	selfkbindex := k.FindBucket(remoteID)
-	fmt.Printf("%s", selfkbindex)
+	fmt.Printf("%d", selfkbindex)
 	kb := &k.table[selfkbindex]
 	contains, i := kb.FindContactInKBucket(c)
 	if !contains {
@@ -100,3 +102,145 @@ func TestAddToTail(t *testing.T) {
 		}
 	}
 }
+
+// generateBucketKademlia creates a node with K = 2 and three others that
+// all fall into the same bucket of its routing table. The node comes first.
+func generateBucketKademlia(network *SimNetwork) []*Kademlia {
+	ids := make([]ID, 4)
+	ids[0][0] = 0x01
+	for i := 1; i < len(ids); i++ {
+		ids[i][0] = 0x80
+		ids[i][IDBytes-1] = byte(i)
+	}
+	nodes := make([]*Kademlia, 0, len(ids))
+	for i, id := range ids {
+		config := Config{NodeID: id, Transport: network.Transport(), K: 2}
+		instance, err := NewKademliaWithConfig(SimAddress(i), config)
+		if err != nil {
+			panic(err)
+		}
+		nodes = append(nodes, instance)
+	}
+	return nodes
+}
+
+func TestReplacementCache(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := generateBucketKademlia(network)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	k := nodes[0]
+	for _, node := range nodes[1:] {
+		k.DoPing(node.SelfContact.Host, node.SelfContact.Port)
+	}
+	bucket := k.FindBucket(nodes[1].NodeID)
+	table := k.copyTable()
+	if len(table[bucket]) != 2 {
+		t.Fatal("Expected a full bucket, got ", table[bucket])
+	}
+	if contains, _ := table[bucket].FindContactInKBucket(nodes[3].SelfContact); contains {
+		t.Error("Contact added to a full bucket with a live head")
+	}
+
+	// The head dies; lookups that fail to reach it replace it with the
+	// cached contact.
+	nodes[1].Close()
+	for i := 0; i < staleFailures; i++ {
+		if _, err := k.DoFindNode(&nodes[1].SelfContact, NewRandomID()); err == nil {
+			t.Error("FindNode on a closed node succeeded")
+		}
+	}
+	table = k.copyTable()
+	if contains, _ := table[bucket].FindContactInKBucket(nodes[1].SelfContact); contains {
+		t.Error("Dead contact still in its bucket")
+	}
+	if contains, _ := table[bucket].FindContactInKBucket(nodes[3].SelfContact); !contains {
+		t.Error("Cached contact not promoted")
+	}
+	if len(table[bucket]) != 2 {
+		t.Error("Expected 2 contacts after promotion, got ", len(table[bucket]))
+	}
+}
+
+func TestEvictionDoesNotBlock(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.Timeout = 500 * time.Millisecond
+	nodes := generateBucketKademlia(network)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	k := nodes[0]
+	k.Update(nodes[1].SelfContact)
+	k.Update(nodes[2].SelfContact)
+
+	// Pings to the head now go unanswered until the network times out.
+	network.Partition([]string{SimAddress(0), SimAddress(2)})
+	start := time.Now()
+	k.Update(nodes[3].SelfContact)
+	if _, err := k.FindContact(nodes[1].NodeID); err != nil {
+		t.Error("Head left the bucket before its ping timed out")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Error("Update blocked on the eviction ping for ", elapsed)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := k.FindContact(nodes[3].NodeID); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := k.FindContact(nodes[3].NodeID); err != nil {
+		t.Error("New contact did not replace the dead head")
+	}
+	if _, err := k.FindContact(nodes[1].NodeID); err == nil {
+		t.Error("Dead head still in its bucket")
+	}
+}
+
+func TestFindClosestSorted(t *testing.T) {
+	network := NewSimNetwork(1)
+	k, err := NewKademliaWithConfig(SimAddress(0), Config{Transport: network.Transport()})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer k.Close()
+	for i := 1; i <= 200; i++ {
+		host, port, _ := net.SplitHostPort(SimAddress(i))
+		portInt, _ := strconv.Atoi(port)
+		k.Update(Contact{NewRandomID(), net.ParseIP(host), uint16(portInt)})
+	}
+	// Let the pings checking the heads of full buckets fail and settle.
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		key := NewRandomID()
+		closest := k.FindClosest(key)
+		table := k.copyTable()
+		all := table.GetContacts()
+		if len(closest) != DefaultK {
+			t.Fatal("Expected ", DefaultK, " contacts, got ", len(closest))
+		}
+		for j := 1; j < len(closest); j++ {
+			if !key.DistanceTo(closest[j-1].NodeID).Less(key.DistanceTo(closest[j].NodeID)) {
+				t.Error("Contacts not sorted by distance")
+			}
+		}
+		farthest := key.DistanceTo(closest[len(closest)-1].NodeID)
+		closer := 0
+		for _, c := range all {
+			if !farthest.Less(key.DistanceTo(c.NodeID)) {
+				closer++
+			}
+		}
+		if closer != len(closest) {
+			t.Error("FindClosest skipped ", closer-len(closest), " closer contacts")
+		}
+	}
+}
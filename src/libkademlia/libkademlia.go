@@ -4,27 +4,25 @@ package libkademlia
 // as a receiver for the RPC methods, which is required by that package.
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"net/rpc"
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	alpha = 3
-	b     = 8 * IDBytes
-	k     = 20
-)
-
 // Key value pair of data
 type KVPair struct {
-	key   ID
-	value []byte
+	key      ID
+	value    []byte
+	expires  time.Time
+	received time.Time
+	sender   ID
 }
 
 // Kademlia type. You can put whatever state you need in this.
@@ -32,12 +30,35 @@ type Kademlia struct {
 	NodeID      ID
 	SelfContact Contact
 	table       RoutingTable
-	data        map[ID][]byte
+	// replacements holds, per bucket, contacts seen while the bucket was
+	// full, most recently seen last. failures counts the RPCs in a row each
+	// contact has failed. checking marks the buckets whose head is being
+	// pinged. All belong to HandleUpdateAndFindContact.
+	replacements RoutingTable
+	failures     map[ID]int
+	checking     [MaxIDBits]bool
+	// store holds the values kept for other nodes and usage counts them,
+	// both guarded by dataLock.
+	store Store
+	usage *storeUsage
+	// published holds the values this node republishes, guarded by
+	// publishLock.
+	published   map[ID]*publishedValue
+	publishLock *sync.Mutex
 	channel     KademliaChannel
 	//vdo
 	Vdos         map[ID]VanashingDataObject
 	VdoMutexLock *sync.Mutex
 	dataLock     *sync.Mutex
+	transport    Transport
+	closeOnce    *sync.Once
+	config       Config
+	// ctx is cancelled by Close, ending the node's background work.
+	ctx         context.Context
+	cancel      context.CancelFunc
+	refreshLock *sync.Mutex
+	lastLookup  [MaxIDBits]time.Time
+	rtt         *rttEstimator
 }
 
 // KademliaChannel type used for communications
@@ -48,10 +69,20 @@ type KademliaChannel struct {
 	findContactResultChan  chan Contact
 	findContactSucceedChan chan bool
 	storeDataChan          chan *KVPair
+	storeDataResChan       chan error
 	valueLookUpChan        chan ID
-	valLookUpResChan       chan []byte
+	valLookUpResChan       chan *KVPair
 	localFindValueChan     chan ID
-	localFindValueResChan  chan []byte
+	localFindValueResChan  chan *KVPair
+	tableChan              chan bool
+	findClosestChan        chan ID
+	findClosestResChan     chan []Contact
+	contactStatusChan      chan contactStatus
+	headCheckedChan        chan headCheck
+	tableResChan           chan RoutingTable
+	handOffChan            chan Contact
+	// done is closed by Kademlia.Close to stop the handlers.
+	done chan struct{}
 }
 
 func (kc *KademliaChannel) Initialize() {
@@ -61,53 +92,171 @@ func (kc *KademliaChannel) Initialize() {
 	kc.findContactResultChan = make(chan Contact)
 	kc.findContactSucceedChan = make(chan bool)
 	kc.storeDataChan = make(chan *KVPair)
+	kc.storeDataResChan = make(chan error)
 	kc.valueLookUpChan = make(chan ID)
-	kc.valLookUpResChan = make(chan []byte)
+	kc.valLookUpResChan = make(chan *KVPair)
 	kc.localFindValueChan = make(chan ID)
-	kc.localFindValueResChan = make(chan []byte)
+	kc.localFindValueResChan = make(chan *KVPair)
+	kc.tableChan = make(chan bool)
+	kc.findClosestChan = make(chan ID)
+	kc.findClosestResChan = make(chan []Contact)
+	kc.contactStatusChan = make(chan contactStatus)
+	kc.headCheckedChan = make(chan headCheck)
+	kc.tableResChan = make(chan RoutingTable)
+	kc.handOffChan = make(chan Contact, handOffQueueSize)
+	kc.done = make(chan struct{})
 }
 
 func NewKademliaWithId(laddr string, nodeID ID) *Kademlia {
+	return NewKademliaWithTransport(laddr, nodeID, NewHTTPTransport())
+}
+
+// NewKademliaWithTransport creates a node that sends and serves all of its
+// RPCs through the given transport. Like NewKademlia it returns nil for a
+// malformed address and exits the process if the node cannot start; use
+// NewKademliaWithConfig to handle those failures instead.
+func NewKademliaWithTransport(laddr string, nodeID ID, transport Transport) *Kademlia {
+	k, err := NewKademliaWithConfig(laddr, Config{NodeID: nodeID, Transport: transport})
+	if _, ok := err.(*AddressError); ok {
+		return nil
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	return k
+}
+
+func NewKademlia(laddr string) *Kademlia {
+	return NewKademliaWithId(laddr, NewRandomID())
+}
+
+// NewKademliaWithConfig creates a node listening on laddr. It fails with an
+// *AddressError if laddr is not a host:port pair, a *ConfigError for an
+// invalid option, a *SnapshotError if the data directory holds a snapshot
+// that cannot be read or whose IDs are not IDBits long, a *StoreError if the
+// value log there cannot be opened, a *BindError if the transport cannot
+// listen on laddr, and a *ResolveError if the bound host has no usable IP
+// address.
+func NewKademliaWithConfig(laddr string, config Config) (*Kademlia, error) {
+	if _, _, err := net.SplitHostPort(laddr); err != nil {
+		return nil, &AddressError{laddr, err}
+	}
+	var snapshot *tableSnapshot
+	if config.DataDir != "" {
+		var err error
+		if snapshot, err = loadSnapshot(config.DataDir, config.IDBits); err != nil {
+			return nil, err
+		}
+	}
+	if snapshot != nil {
+		if config.IDBits == 0 {
+			config.IDBits = snapshot.IDBits
+		}
+		if config.NodeID == (ID{}) {
+			config.NodeID = snapshot.nodeID
+		}
+	}
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	store, err := openStore(config)
+	if err != nil {
+		return nil, err
+	}
+	usage, err := newStoreUsage(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
 	k := new(Kademlia)
-	k.NodeID = nodeID
+	k.NodeID = config.NodeID
+	k.transport = config.Transport
+	k.config = config
 
 	// TODO: Initialize other state here as you add functionality.
 	k.table.Initialize()
-	k.data = make(map[ID][]byte)
+	k.replacements.Initialize()
+	k.failures = make(map[ID]int)
+	k.store = store
+	k.usage = usage
 	k.channel.Initialize()
 	//vdo init
 	k.Vdos = make(map[ID]VanashingDataObject)
 	k.VdoMutexLock = &sync.Mutex{}
 	k.dataLock = &sync.Mutex{}
+	k.published = make(map[ID]*publishedValue)
+	k.publishLock = &sync.Mutex{}
 	//vdo init finished
+	k.closeOnce = &sync.Once{}
+	k.ctx, k.cancel = context.WithCancel(context.Background())
+	k.refreshLock = &sync.Mutex{}
+	k.rtt = newRTTEstimator()
+	k.touchAllBuckets(time.Now())
 	go k.HandleUpdateAndFindContact()
 	go k.HandleDataStore()
 	go k.HandleValueLookUp()
 	go k.HandleLocalFindValue()
+	go k.HandleExpiry()
+	go k.HandleHandOff()
 	// Set up RPC server
 	// NOTE: KademliaRPC is just a wrapper around Kademlia. This type includes
 	// the RPC functions.
 
-	s := rpc.NewServer()
-	s.Register(&KademliaRPC{k})
-	hostname, port, err := net.SplitHostPort(laddr)
+	addr, err := k.transport.Listen(laddr)
 	if err != nil {
-		return nil
-	}
-	s.HandleHTTP(rpc.DefaultRPCPath+port,
-		rpc.DefaultDebugPath+port)
-	l, err := net.Listen("tcp", laddr)
-	if err != nil {
-		log.Fatal("Listen: ", err)
+		k.cancel()
+		close(k.channel.done)
+		k.store.Close()
+		return nil, &BindError{laddr, err}
 	}
 
-	// Run RPC server forever.
-	go http.Serve(l, nil)
-
 	// Add self contact
-	hostname, port, _ = net.SplitHostPort(l.Addr().String())
+	hostname, port, _ := net.SplitHostPort(addr.String())
 	port_int, _ := strconv.Atoi(port)
+	host, err := resolveHost(hostname)
+	if err != nil {
+		// Keep any earlier snapshot; this node never got to do anything.
+		k.config.DataDir = ""
+		k.Close()
+		return nil, err
+	}
+	k.SelfContact = Contact{k.NodeID, host, uint16(port_int)}
+	// Only serve once the node is complete; RPC handlers read SelfContact.
+	s := rpc.NewServer()
+	if k.shortWireIDs() {
+		s.RegisterName("KademliaRPC", &wireRPC{&KademliaRPC{k}})
+	} else {
+		s.Register(&KademliaRPC{k})
+	}
+	k.transport.Serve(s)
+	if k.config.RefreshInterval > 0 {
+		go k.HandleBucketRefresh()
+	}
+	if k.config.DataDir != "" {
+		go k.HandleSnapshot()
+	}
+	if k.config.RepublishInterval > 0 {
+		go k.HandleRepublish()
+	}
+	if k.config.ReplicateInterval > 0 {
+		go k.HandleReplicate()
+	}
+	if snapshot != nil {
+		go k.restoreContacts(snapshot.contacts())
+	}
+	return k, nil
+}
+
+// resolveHost looks up the IP address of a host, preferring IPv4.
+func resolveHost(hostname string) (net.IP, error) {
 	ipAddrStrings, err := net.LookupHost(hostname)
+	if err == nil && len(ipAddrStrings) == 0 {
+		err = &CommandFailed{"no addresses"}
+	}
+	if err != nil {
+		return nil, &ResolveError{hostname, err}
+	}
 	var host net.IP
 	for i := 0; i < len(ipAddrStrings); i++ {
 		host = net.ParseIP(ipAddrStrings[i])
@@ -115,12 +264,33 @@ func NewKademliaWithId(laddr string, nodeID ID) *Kademlia {
 			break
 		}
 	}
-	k.SelfContact = Contact{k.NodeID, host, uint16(port_int)}
-	return k
+	return host, nil
 }
 
-func NewKademlia(laddr string) *Kademlia {
-	return NewKademliaWithId(laddr, NewRandomID())
+// Close shuts the node down. It saves a snapshot if the node has a data
+// directory, stops accepting RPCs, waits for the ones in flight to finish,
+// stops the handler goroutines and releases the listener, after which the
+// address may be bound again. Calling Close more than once is harmless.
+func (k *Kademlia) Close() error {
+	var err error
+	k.closeOnce.Do(func() {
+		k.cancel()
+		snapshotErr := k.SaveSnapshot()
+		// The transport drains first, since in-flight RPCs still need the
+		// handlers.
+		err = k.transport.Close()
+		close(k.channel.done)
+		k.dataLock.Lock()
+		storeErr := k.store.Close()
+		k.dataLock.Unlock()
+		if err == nil {
+			err = snapshotErr
+		}
+		if err == nil {
+			err = storeErr
+		}
+	})
+	return err
 }
 
 //////////////////////////////////
@@ -136,6 +306,49 @@ type ValueNotFoundError struct {
 type CommandFailed struct {
 	msg string
 }
+type RPCTimeoutError struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+// Errors returned by NewKademliaWithConfig.
+type ConfigError struct {
+	Option string
+	Value  int
+}
+type SnapshotError struct {
+	Path string
+	Err  error
+}
+
+// CorruptValueError reports a value that does not match the content ID it
+// was stored under.
+type CorruptValueError struct {
+	Key ID
+}
+
+// StoreRefusedError is what a node that will not hold a value returns in
+// StoreResult.Err.
+type StoreRefusedError struct {
+	Key    ID
+	Reason string
+}
+type StoreError struct {
+	Path string
+	Err  error
+}
+type AddressError struct {
+	Addr string
+	Err  error
+}
+type BindError struct {
+	Addr string
+	Err  error
+}
+type ResolveError struct {
+	Host string
+	Err  error
+}
 
 func (e *ContactNotFoundError) Error() string {
 	return fmt.Sprintf("%x %s", e.id, e.msg)
@@ -146,6 +359,35 @@ func (e *ValueNotFoundError) Error() string {
 func (e *CommandFailed) Error() string {
 	return fmt.Sprintf("%s", e.msg)
 }
+func (e *RPCTimeoutError) Error() string {
+	return fmt.Sprintf("No reply from %s within %v", e.Addr, e.Timeout)
+}
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("Bad value %d for option %s", e.Value, e.Option)
+}
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("Unable to use snapshot %s: %s", e.Path, e.Err)
+}
+func (e *CorruptValueError) Error() string {
+	return fmt.Sprintf("Value for key %s does not match its content ID", e.Key.AsString())
+}
+func (e *StoreRefusedError) Error() string {
+	return fmt.Sprintf("Store of %s refused: %s", e.Key.AsString(), e.Reason)
+}
+func (e *StoreError) Error() string {
+	return fmt.Sprintf("Unable to use store %s: %s", e.Path, e.Err)
+}
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("Bad address %s: %s", e.Addr, e.Err)
+}
+func (e *BindError) Error() string {
+	return fmt.Sprintf("Unable to listen on %s: %s", e.Addr, e.Err)
+}
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("Unable to resolve host %s: %s", e.Host, e.Err)
+}
+
+var errNodeClosed = &CommandFailed{"node closed"}
 
 func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	// TODO: Search through contacts, find specified ID
@@ -158,7 +400,11 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 	if bucketIndex == -1 {
 		return nil, &ContactNotFoundError{nodeId, "Not found"}
 	}
-	k.channel.findContactChan <- nodeId
+	select {
+	case k.channel.findContactChan <- nodeId:
+	case <-k.channel.done:
+		return nil, &ContactNotFoundError{nodeId, "Not found"}
+	}
 	contact := <-k.channel.findContactResultChan
 	flag := <-k.channel.findContactSucceedChan
 	if flag {
@@ -171,72 +417,69 @@ func (k *Kademlia) FindContact(nodeId ID) (*Contact, error) {
 //Doing corresponding RPC calls
 //////////////////////////////////////////////////////
 func (k *Kademlia) DoPing(host net.IP, port uint16) (*Contact, error) {
-	// TODO: Implement
-	addr := fmt.Sprintf("%v:%v", host, port)
-	port_str := fmt.Sprintf("%v", port)
-	path := rpc.DefaultRPCPath + port_str
-	client, err := rpc.DialHTTPPath("tcp", addr, path)
-	if err != nil {
+	return k.DoPingContext(context.Background(), host, port)
+}
+func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) error {
+	return k.DoStoreContext(context.Background(), contact, key, value)
+}
+
+// DoStoreTTL is DoStore for a value the contact should keep for ttl. A ttl
+// of 0 leaves it to the contact's ValueTTL.
+func (k *Kademlia) DoStoreTTL(contact *Contact, key ID, value []byte, ttl time.Duration) error {
+	return k.DoStoreTTLContext(context.Background(), contact, key, value, ttl)
+}
+func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) ([]Contact, error) {
+	return k.DoFindNodeContext(context.Background(), contact, searchKey)
+}
+func (k *Kademlia) DoFindValue(contact *Contact,
+	searchKey ID) (value []byte, contacts []Contact, err error) {
+	return k.DoFindValueContext(context.Background(), contact, searchKey)
+}
+
+// The Context variants below abandon the RPC and return ctx.Err() as soon
+// as ctx is cancelled or its deadline passes.
+func (k *Kademlia) DoPingContext(ctx context.Context, host net.IP, port uint16) (*Contact, error) {
+	sender, err := k.ping(ctx, &Contact{Host: host, Port: port})
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return nil, err
+	} else if err != nil {
 		return nil, &CommandFailed{
 			"Unable to ping " + fmt.Sprintf("%s:%v", host.String(), port)}
 	}
-	defer client.Close()
-	ping := PingMessage{k.SelfContact, NewRandomID()}
-	var pong PongMessage
-	err = client.Call("KademliaRPC.Ping", ping, &pong)
-	if err != nil {
-		return nil, err
-	}
 
-	k.Update(pong.Sender)
-	return &pong.Sender, nil
+	k.Update(sender)
+	return &sender, nil
 
 }
-func (k *Kademlia) DoStore(contact *Contact, key ID, value []byte) error {
-	// TODO: Implement
-	addr := fmt.Sprintf("%v:%v", (*contact).Host, (*contact).Port)
-	port_str := strconv.Itoa(int((*contact).Port))
-	path := rpc.DefaultRPCPath + port_str
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		addr,
-		path,
-	)
-	if err != nil {
-		return err
-	}
-	defer client.Close()
 
-	req := StoreRequest{k.SelfContact, NewRandomID(), key, value}
+// ping sends a PING without touching the routing table, so checkHead can use
+// it to check a bucket's head.
+func (k *Kademlia) ping(ctx context.Context, contact *Contact) (Contact, error) {
+	ping := PingMessage{k.SelfContact, NewRandomID()}
+	var pong PongMessage
+	err := k.timedCall(ctx, contact, "KademliaRPC.Ping", ping, &pong)
+	return pong.Sender, err
+}
+func (k *Kademlia) DoStoreContext(ctx context.Context, contact *Contact, key ID, value []byte) error {
+	return k.DoStoreTTLContext(ctx, contact, key, value, 0)
+}
+func (k *Kademlia) DoStoreTTLContext(ctx context.Context, contact *Contact, key ID, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return &CommandFailed{"negative TTL " + ttl.String()}
+	}
+	req := StoreRequest{k.SelfContact, NewRandomID(), key, value, ttl}
 	var res StoreResult
-
-	err = client.Call("KademliaRPC.Store", req, &res)
-	//fmt.Println("dostore reaches here step6 !")
-	if err != nil {
-		client.Close()
+	if err := k.call(ctx, contact, "KademliaRPC.Store", req, &res); err != nil {
 		return err
 	}
-	return nil
+	return res.Err
 }
 
-func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) ([]Contact, error) {
-	// TODO: Implement
-	addr := fmt.Sprintf("%s:%d", (*contact).Host.String(), (*contact).Port)
-	port_str := strconv.Itoa(int((*contact).Port))
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		addr,
-		rpc.DefaultRPCPath+port_str,
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
+func (k *Kademlia) DoFindNodeContext(ctx context.Context, contact *Contact, searchKey ID) ([]Contact, error) {
 	req := FindNodeRequest{k.SelfContact, NewRandomID(), searchKey}
 	var res FindNodeResult
-	err = client.Call("KademliaRPC.FindNode", req, &res)
+	err := k.call(ctx, contact, "KademliaRPC.FindNode", req, &res)
 	if err != nil {
-		client.Close()
 		return nil, err
 	}
 	for _, each := range res.Nodes {
@@ -245,55 +488,85 @@ func (k *Kademlia) DoFindNode(contact *Contact, searchKey ID) ([]Contact, error)
 	return res.Nodes, nil
 }
 
-func (k *Kademlia) DoFindValue(contact *Contact,
+func (k *Kademlia) DoFindValueContext(ctx context.Context, contact *Contact,
 	searchKey ID) (value []byte, contacts []Contact, err error) {
-	// TODO: Implement
-	addr := fmt.Sprintf("%s:%d", (*contact).Host.String(), (*contact).Port)
-	port_str := strconv.Itoa(int((*contact).Port))
-	path := rpc.DefaultRPCPath + port_str
-	client, err := rpc.DialHTTPPath(
-		"tcp",
-		addr,
-		path,
-	)
-	if err != nil {
-		return nil, nil, err
-	}
-	defer client.Close()
+	value, _, contacts, err = k.findValue(ctx, contact, searchKey)
+	return
+}
+
+// findValue is DoFindValueContext that also returns how much longer the
+// contact will keep the value it found.
+func (k *Kademlia) findValue(ctx context.Context, contact *Contact,
+	searchKey ID) (value []byte, ttl time.Duration, contacts []Contact, err error) {
 	req := FindValueRequest{k.SelfContact, NewRandomID(), searchKey}
 	var res FindValueResult
-	err = client.Call("KademliaRPC.FindValue", req, &res)
+	err = k.call(ctx, contact, "KademliaRPC.FindValue", req, &res)
 	if err != nil {
-		client.Close()
-		return nil, nil, err
+		return nil, 0, nil, err
 	}
 	if res.Value != nil {
-		return res.Value, res.Nodes, nil
+		return res.Value, res.TTL, res.Nodes, nil
 	} else if res.Nodes != nil {
 		for _, node := range res.Nodes {
 			k.Update(node)
 		}
-		return res.Value, res.Nodes, nil
-	} else {
-		return nil, nil, &CommandFailed{"Value Not Found"}
+		return res.Value, 0, res.Nodes, nil
 	}
-	return nil, nil, &CommandFailed{"Value Not Found"}
+	return nil, 0, nil, &CommandFailed{"Value Not Found"}
+}
+
+// call sends a single RPC to contact over the node's transport.
+// call makes an RPC to a contact and reports to the routing table whether
+// the contact answered.
+func (k *Kademlia) call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	err := k.timedCall(ctx, contact, method, args, reply)
+	if _, ok := err.(*RPCTimeoutError); ok && unsizedReply(reply) {
+		// The timeout could not allow for the value the reply may carry, so
+		// the contact is not held to it.
+		return err
+	}
+	if err == nil || brokenConn(err) {
+		select {
+		case k.channel.contactStatusChan <- contactStatus{*contact, err != nil, false}:
+		case <-k.channel.done:
+		}
+	}
+	return err
 }
 
 ///////////////////////////////////////////
 //Interfaces of kademlia
 ///////////////////////////////////////////
-func (k *Kademlia) StoreData(pair *KVPair) {
-	k.channel.storeDataChan <- pair
+func (k *Kademlia) StoreData(pair *KVPair) error {
+	select {
+	case k.channel.storeDataChan <- pair:
+		return <-k.channel.storeDataResChan
+	case <-k.channel.done:
+		return errNodeClosed
+	}
 }
 func (k *Kademlia) Update(c Contact) {
 	//Update KBucket in Routing Table by Contact c
-	k.channel.updateChan <- c
-	_ = <-k.channel.updateFinishedChan
+	select {
+	case k.channel.updateChan <- c:
+		_ = <-k.channel.updateFinishedChan
+	case <-k.channel.done:
+	}
 }
 func (k *Kademlia) LookUpValue(key ID) ([]byte, error) {
+	pair, err := k.lookUpPair(key)
+	if err != nil {
+		return nil, err
+	}
+	return pair.value, nil
+}
+func (k *Kademlia) lookUpPair(key ID) (*KVPair, error) {
 	//TODO: add lookup request to channel
-	k.channel.valueLookUpChan <- key
+	select {
+	case k.channel.valueLookUpChan <- key:
+	case <-k.channel.done:
+		return nil, &ValueNotFoundError{key}
+	}
 	valLookUpResult := <-k.channel.valLookUpResChan
 	if valLookUpResult != nil {
 		return valLookUpResult, nil
@@ -307,15 +580,35 @@ func (k *Kademlia) LookUpValue(key ID) ([]byte, error) {
 ///////////////////////////////////////////
 func (k *Kademlia) HandleDataStore() {
 	for {
-		kvpair := <-k.channel.storeDataChan
-		k.data[kvpair.key] = kvpair.value
+		var kvpair *KVPair
+		select {
+		case kvpair = <-k.channel.storeDataChan:
+		case <-k.channel.done:
+			return
+		}
+		k.dataLock.Lock()
+		err := k.putStored(kvpair)
+		k.dataLock.Unlock()
+		k.channel.storeDataResChan <- err
 	}
 }
 func (k *Kademlia) HandleLocalFindValue() {
 	for {
-		searchKey := <-k.channel.localFindValueChan
-		if val, ok := k.data[searchKey]; ok {
-			k.channel.localFindValueResChan <- val
+		var searchKey ID
+		select {
+		case searchKey = <-k.channel.localFindValueChan:
+		case <-k.channel.done:
+			return
+		}
+		k.dataLock.Lock()
+		stored, ok, err := k.store.Get(searchKey)
+		k.dataLock.Unlock()
+		// Expired values are gone even if the sweeper has yet to notice.
+		if err == nil && ok && time.Now().Before(stored.Expires) {
+			k.dataLock.Lock()
+			k.usage.touch(searchKey, time.Now())
+			k.dataLock.Unlock()
+			k.channel.localFindValueResChan <- &KVPair{searchKey, stored.Value, stored.Expires, stored.Received, stored.Sender}
 		} else {
 			k.channel.localFindValueResChan <- nil
 		}
@@ -323,13 +616,13 @@ func (k *Kademlia) HandleLocalFindValue() {
 }
 func (k *Kademlia) HandleValueLookUp() {
 	for {
-		key := <-k.channel.valueLookUpChan
-		val, err := k.LocalFindValue(key)
-		if err != nil {
-			k.channel.valLookUpResChan <- nil
-		} else {
-			k.channel.valLookUpResChan <- val
+		var key ID
+		select {
+		case key = <-k.channel.valueLookUpChan:
+		case <-k.channel.done:
+			return
 		}
+		k.channel.valLookUpResChan <- k.localFindPair(key)
 	}
 }
 func (k *Kademlia) HandleUpdateAndFindContact() {
@@ -344,21 +637,25 @@ func (k *Kademlia) HandleUpdateAndFindContact() {
 				continue
 			}
 			kb := &k.table[bucketIndex]
+			delete(k.failures, c.NodeID)
 			contains, i := kb.FindContactInKBucket(c)
 			if contains {
 				kb.MoveToTail(i)
 			} else {
-				if len(*kb) < cap(*kb) {
+				if len(*kb) < k.config.K {
 					kb.AddToTail(c)
+					if cached, j := k.replacements[bucketIndex].FindContactInKBucket(c); cached {
+						k.replacements[bucketIndex].Remove(j)
+					}
+					k.queueHandOff(c)
 				} else {
-					//fmt.Println("filled")
-					head := (*kb)[0]
-					_, err := k.DoPing(head.Host, head.Port)
-					if err != nil {
-						kb.Remove(0)
-						kb.AddToTail(c)
-					} else {
-						kb.MoveToTail(0)
+					// The new contact waits in the replacement cache while
+					// the head is pinged; it takes the head's place if the
+					// head turns out to be dead.
+					k.replacements[bucketIndex].AddReplacement(c, k.config.K)
+					if !k.checking[bucketIndex] {
+						k.checking[bucketIndex] = true
+						go k.checkHead(bucketIndex, (*kb)[0])
 					}
 				}
 			}
@@ -378,6 +675,30 @@ func (k *Kademlia) HandleUpdateAndFindContact() {
 			}
 			k.channel.findContactResultChan <- contactResult
 			k.channel.findContactSucceedChan <- flag
+		case status := <-k.channel.contactStatusChan:
+			k.updateContactStatus(status)
+		case check := <-k.channel.headCheckedChan:
+			k.checking[check.bucketIndex] = false
+			kb := &k.table[check.bucketIndex]
+			contains, i := kb.FindContactInKBucket(check.head)
+			if !contains {
+				continue
+			}
+			if check.alive {
+				kb.MoveToTail(i)
+			} else {
+				k.evict(check.bucketIndex, i)
+			}
+		case key := <-k.channel.findClosestChan:
+			k.channel.findClosestResChan <- k.closestContacts(key)
+		case <-k.channel.tableChan:
+			var table RoutingTable
+			for i, kb := range k.table {
+				table[i] = append(KBucket(nil), kb...)
+			}
+			k.channel.tableResChan <- table
+		case <-k.channel.done:
+			return
 		}
 	}
 }
@@ -387,10 +708,9 @@ func (k *Kademlia) HandleUpdateAndFindContact() {
 ///////////////////////////////////////////////
 func (k *Kademlia) LocalFindValue(searchKey ID) ([]byte, error) {
 	// TODO: Implement
-	k.channel.localFindValueChan <- searchKey
-	val := <-k.channel.localFindValueResChan
-	if val != nil {
-		return val, nil
+	pair := k.localFindPair(searchKey)
+	if pair != nil {
+		return pair.value, nil
 	} else {
 		return nil, &ValueNotFoundError{searchKey}
 	}
@@ -400,58 +720,124 @@ func (k *Kademlia) LocalFindValue(searchKey ID) ([]byte, error) {
 	// 	return nil, &ValueNotFoundError{searchKey}
 	// }
 }
-func (k *Kademlia) FindClosest(key ID) []Contact {
-	prefixLen := k.NodeID.Xor(key).PrefixLen()
-	var index int
-	if prefixLen == 160 {
-		index = 0
-	} else {
-		index = 159 - prefixLen
+
+// localFindPair returns the stored pair for searchKey, or nil if there is
+// none or it has expired.
+func (k *Kademlia) localFindPair(searchKey ID) *KVPair {
+	select {
+	case k.channel.localFindValueChan <- searchKey:
+	case <-k.channel.done:
+		return nil
 	}
-	contacts := make([]Contact, 0, 20)
-	for _, val := range k.table[index] {
-		if len(contacts) < 20 {
-			contacts = append(contacts, val)
-		} else {
-			return contacts
+	return <-k.channel.localFindValueResChan
+}
+
+// contactStatus reports whether an RPC to contact failed, or whether the
+// contact answered with corrupt data.
+type contactStatus struct {
+	contact Contact
+	failed  bool
+	corrupt bool
+}
+
+// updateContactStatus keeps count of the RPCs in a row a contact has
+// failed. A contact in the routing table that fails staleFailures of them,
+// or that answers with corrupt data even once, is replaced by the most
+// recently seen contact in its bucket's replacement cache.
+func (k *Kademlia) updateContactStatus(status contactStatus) {
+	id := status.contact.NodeID
+	if !status.failed && !status.corrupt {
+		delete(k.failures, id)
+		return
+	}
+	bucketIndex := k.FindBucket(id)
+	if bucketIndex == -1 {
+		return
+	}
+	kb := &k.table[bucketIndex]
+	cache := &k.replacements[bucketIndex]
+	contains, i := kb.FindContactInKBucket(status.contact)
+	if !contains {
+		if cached, j := cache.FindContactInKBucket(status.contact); cached {
+			cache.Remove(j)
 		}
+		return
 	}
+	k.failures[id]++
+	if k.failures[id] < staleFailures && !status.corrupt {
+		return
+	}
+	k.evict(bucketIndex, i)
+}
 
-	if len(contacts) >= 20 {
-		return contacts
+// evict removes the i'th contact of a bucket and promotes the most recently
+// seen contact of the bucket's replacement cache in its place.
+func (k *Kademlia) evict(bucketIndex int, i int) {
+	kb := &k.table[bucketIndex]
+	cache := &k.replacements[bucketIndex]
+	delete(k.failures, (*kb)[i].NodeID)
+	kb.Remove(i)
+	if n := len(*cache); n > 0 {
+		kb.AddToTail((*cache)[n-1])
+		k.queueHandOff((*cache)[n-1])
+		cache.Remove(n - 1)
 	}
+}
 
-	//If the target kbucket has less than k contact, search higher bucket first, then lower bucket
-	higher := index
-	lower := index
-	for {
-		if len(contacts) >= 20 {
-			return contacts
-		}
-		if higher < 159 {
-			higher++
-			for _, val := range k.table[higher] {
-				if len(contacts) < 20 {
-					contacts = append(contacts, val)
-				} else {
-					return contacts
-				}
-			}
-		}
-		if lower > 0 {
-			lower--
-			for _, val := range k.table[lower] {
-				if len(contacts) < 20 {
-					contacts = append(contacts, val)
-				} else {
-					return contacts
-				}
-			}
-		}
-		if higher == 159 && lower == 0 {
-			return contacts
+// headCheck reports whether the head of a full bucket answered a ping.
+type headCheck struct {
+	bucketIndex int
+	head        Contact
+	alive       bool
+}
+
+// checkHead pings the head of a full bucket and hands the outcome back to
+// HandleUpdateAndFindContact, which keeps serving other requests meanwhile.
+func (k *Kademlia) checkHead(bucketIndex int, head Contact) {
+	_, err := k.ping(k.ctx, &head)
+	select {
+	case k.channel.headCheckedChan <- headCheck{bucketIndex, head, err == nil}:
+	case <-k.channel.done:
+	}
+}
+
+// copyTable returns a copy of the routing table taken by its handler.
+func (k *Kademlia) copyTable() (table RoutingTable) {
+	select {
+	case k.channel.tableChan <- true:
+	case <-k.channel.done:
+		return
+	}
+	return <-k.channel.tableResChan
+}
+
+// FindClosest returns the K contacts of the routing table closest to key,
+// closest first.
+func (k *Kademlia) FindClosest(key ID) []Contact {
+	select {
+	case k.channel.findClosestChan <- key:
+	case <-k.channel.done:
+		return nil
+	}
+	return <-k.channel.findClosestResChan
+}
+
+// closestContacts does the work of FindClosest for its handler.
+func (k *Kademlia) closestContacts(key ID) []Contact {
+	candidates := make([]ShortListElement, 0, k.config.K)
+	for _, kb := range k.table[:k.config.IDBits] {
+		for _, c := range kb {
+			candidates = append(candidates, ShortListElement{c, key.DistanceTo(c.NodeID), 0, false})
 		}
 	}
+	sort.Sort(ShortListElements(candidates))
+	if len(candidates) > k.config.K {
+		candidates = candidates[:k.config.K]
+	}
+	contacts := make([]Contact, 0, len(candidates))
+	for _, val := range candidates {
+		contacts = append(contacts, val.contact)
+	}
 	return contacts
 }
 func (k *Kademlia) FindBucket(nodeId ID) int {
@@ -459,13 +845,18 @@ func (k *Kademlia) FindBucket(nodeId ID) int {
 	if k.NodeID.Equals(nodeId) {
 		return -1
 	}
-	return (IDBits - 1) - k.NodeID.Xor(nodeId).PrefixLen()
+	// IDs that agree in all of the node's IDBits bits share bucket 0.
+	index := (k.config.IDBits - 1) - k.NodeID.Xor(nodeId).PrefixLen()
+	if index < 0 {
+		return 0
+	}
+	return index
 }
 
 // For project 2!
 type ShortListElement struct {
 	contact  Contact
-	distance int
+	distance Distance
 	status   int //0 default, 1 inactive, 2 active
 	hasValue bool
 }
@@ -475,404 +866,139 @@ func (slice ShortListElements) Len() int {
 	return len(slice)
 }
 func (slice ShortListElements) Less(i, j int) bool {
-	return slice[i].distance < slice[j].distance
+	return slice[i].distance.Less(slice[j].distance)
 }
 func (slice ShortListElements) Swap(i, j int) {
 	slice[i], slice[j] = slice[j], slice[i]
 }
 
-func NotEnoughActive(ContactedList []ShortListElement) bool {
-	count_active := 0
-	for _, val := range ContactedList {
-		if val.status == 2 {
-			count_active++
-		}
-	}
-	if count_active < 20 {
-		return true
-	} else {
-		return false
-	}
+func (k *Kademlia) DoIterativeFindNode(id ID) ([]Contact, error) {
+	return k.DoIterativeFindNodeContext(context.Background(), id)
 }
 
-type IterFindNodeResult struct {
-	Receiver Contact
-	Nodes    []Contact
-	Err      error
+// DoIterativeFindNodeContext is DoIterativeFindNode, aborted with ctx.Err()
+// when ctx ends. Any RPCs still in flight are cancelled when it returns.
+func (k *Kademlia) DoIterativeFindNodeContext(ctx context.Context, id ID) ([]Contact, error) {
+	return k.iterativeFindNode(ctx, id, nil)
 }
-
-type IterFindValueResult struct {
-	receiver Contact
-	val      []byte
-	contacts []Contact
-	err      error
+func (k *Kademlia) iterativeFindNode(ctx context.Context, id ID, trace *LookupTrace) ([]Contact, error) {
+	query := func(ctx context.Context, contact *Contact) (res lookupResponse) {
+		res.contacts, res.err = k.DoFindNodeContext(ctx, contact, id)
+		return
+	}
+	ShortList, _, err := k.lookup(ctx, id, query, nil, trace)
+	if err != nil {
+		return nil, err
+	}
+	return ShortList.closestActive(k.config.K), nil
 }
 
-func (k *Kademlia) iteFindNodeHelper(server ShortListElement, id ID, iterFindNodeChan chan IterFindNodeResult) {
-	var res IterFindNodeResult
-	res.Receiver = server.contact
-	res.Nodes, res.Err = k.DoFindNode(&server.contact, id)
-	iterFindNodeChan <- res
+func (k *Kademlia) DoIterativeStore(key ID, value []byte) ([]Contact, error) {
+	return k.DoIterativeStoreContext(context.Background(), key, value)
 }
-func (k *Kademlia) iterFindValueHelper(server ShortListElement, id ID, iterFindValueChan chan IterFindValueResult) {
-	var res IterFindValueResult
-	res.receiver = server.contact
-	res.val, res.contacts, res.err = k.DoFindValue(&server.contact, id)
-	iterFindValueChan <- res
+func (k *Kademlia) DoIterativeStoreContext(ctx context.Context, key ID, value []byte) ([]Contact, error) {
+	return k.DoIterativeStoreTTLContext(ctx, key, value, 0)
 }
 
-func notInList(List []ShortListElement, one_shortlist_element ShortListElement) bool {
-	for _, val := range List {
-		if val.contact.NodeID.Equals(one_shortlist_element.contact.NodeID) {
-			return false
-		}
-	}
-	return true
+// DoIterativeStoreTTL is DoIterativeStore for a value the nodes should keep
+// for ttl. A ttl of 0 leaves it to each node's ValueTTL. Either way the node
+// republishes the value every RepublishInterval until ttl runs out.
+func (k *Kademlia) DoIterativeStoreTTL(key ID, value []byte, ttl time.Duration) ([]Contact, error) {
+	return k.DoIterativeStoreTTLContext(context.Background(), key, value, ttl)
 }
-
-func (k *Kademlia) DoIterativeFindNode(id ID) ([]Contact, error) {
-	ShortList := make([]ShortListElement, 0, 60)
-	ProbingList := make([]ShortListElement, 0, 3)
-	ContactedList := make([]ShortListElement, 0, 30)
-	iterFindNodeChan := make(chan IterFindNodeResult)
-
-	initial_shortlist := k.FindClosest(id)
-	for _, val := range initial_shortlist {
-		one_shortlist_element := ShortListElement{val, 159 - id.Xor(val.NodeID).PrefixLen(), 0, false}
-		ShortList = append(ShortList, one_shortlist_element)
-	}
-	sort.Sort(ShortListElements(ShortList))
-
-	ClosestDistancePre := 160
-	ClosestDistanceNow := 159
-	if len(ShortList) > 0 {
-		ClosestDistanceNow = ShortList[0].distance
-	}
-
-	for ClosestDistanceNow < ClosestDistancePre && NotEnoughActive(ContactedList) {
-		ClosestDistancePre = ClosestDistanceNow
-		ProbingList = nil
-		//dump(ProbingList)
-		i := 0
-		for i < 3 && i < len(ShortList) {
-			ProbingList = append(ProbingList, ShortList[i])
-			i++
-		}
-		ShortList = append(ShortList[:0], ShortList[i:]...)
-		timeout := false
-		timeOutChan := make(chan bool)
-		go func() {
-			time.Sleep(300 * time.Millisecond)
-			timeOutChan <- true
-		}()
-
-		for _, val := range ProbingList {
-			go k.iteFindNodeHelper(val, id, iterFindNodeChan)
-		}
-		allreceive := false
-
-		for !timeout && !allreceive {
-			select {
-			case res := <-iterFindNodeChan:
-				for index, val := range ProbingList {
-					if val.contact.NodeID.Equals(res.Receiver.NodeID) {
-						ProbingList = append(ProbingList[:index], ProbingList[index+1:]...)
-						one_shortlist_element := ShortListElement{res.Receiver, 159 - id.Xor(res.Receiver.NodeID).PrefixLen(), 0, false}
-						if res.Err != nil {
-							one_shortlist_element.status = 1
-						} else {
-							one_shortlist_element.status = 2
-						}
-						ContactedList = append(ContactedList, one_shortlist_element)
-					}
-				}
-				// inContactedList := false
-				// for _, val := range ContactedList {
-				// 	if val.contact.NodeID.Equals(res.Receiver.NodeID) {
-				// 		if res.Err != nil {
-				// 			val.status = 1
-				// 		} else {
-				// 			val.status = 2
-				// 		}
-				// 		inContactedList = true
-				// 	}
-				// }
-				// if !inContactedList {
-				// 	one_shortlist_element := ShortListElement{res.Receiver, 159 - id.Xor(res.Receiver.NodeID).PrefixLen(), 0}
-				// 	if res.Err != nil {
-				// 		one_shortlist_element.status = 1
-				// 	} else {
-				// 		one_shortlist_element.status = 2
-				// 	}
-				// 	ContactedList = append(ContactedList, one_shortlist_element)
-				// }
-				if res.Err == nil {
-					for _, val := range res.Nodes {
-						one_shortlist_element := ShortListElement{val, 159 - id.Xor(val.NodeID).PrefixLen(), 0, false}
-						if notInList(ShortList, one_shortlist_element) && notInList(ProbingList, one_shortlist_element) && notInList(ContactedList, one_shortlist_element) {
-							ShortList = append(ShortList, one_shortlist_element)
-						}
-					}
-				}
-				if len(ProbingList) == 0 {
-					allreceive = true
-				}
-			case timeout = <-timeOutChan:
-				for _, probingval := range ProbingList {
-					// inContactedList := false
-					// for _, contactedval := range ContactedList {
-					// 	if probingval.contact.NodeID.Equals(contactedval.contact.NodeID) {
-					// 		contactedval.status = 1
-					// 		inContactedList = true
-					// 	}
-					// }
-					// if !inContactedList {
-					probingval.status = 1
-					ContactedList = append(ContactedList, probingval)
-					// }
-				}
-			}
-		}
-		sort.Sort(ShortListElements(ShortList))
-		if len(ShortList) > 0 {
-			ClosestDistanceNow = ShortList[0].distance
-		}
+func (k *Kademlia) DoIterativeStoreTTLContext(ctx context.Context, key ID, value []byte, ttl time.Duration) ([]Contact, error) {
+	if ttl < 0 {
+		return nil, &CommandFailed{"negative TTL " + ttl.String()}
 	}
-
-	for NotEnoughActive(ContactedList) && len(ShortList) > 0 {
-		ProbingList = nil
-		//dump(ProbingList)
-		i := 0
-		for i < 3 && i < len(ShortList) {
-			ProbingList = append(ProbingList, ShortList[i])
-			i++
-		}
-		ShortList = append(ShortList[:0], ShortList[i:]...)
-		timeout := false
-		timeOutChan := make(chan bool)
-		go func() {
-			time.Sleep(300 * time.Millisecond)
-			timeOutChan <- true
-		}()
-
-		for _, val := range ProbingList {
-			go k.iteFindNodeHelper(val, id, iterFindNodeChan)
-		}
-		allreceive := false
-
-		for !timeout && !allreceive {
-			select {
-			case res := <-iterFindNodeChan:
-				for index, val := range ProbingList {
-					if val.contact.NodeID.Equals(res.Receiver.NodeID) {
-						ProbingList = append(ProbingList[:index], ProbingList[index+1:]...)
-						one_shortlist_element := ShortListElement{res.Receiver, 159 - id.Xor(res.Receiver.NodeID).PrefixLen(), 0, false}
-						if res.Err != nil {
-							one_shortlist_element.status = 1
-						} else {
-							one_shortlist_element.status = 2
-						}
-						ContactedList = append(ContactedList, one_shortlist_element)
-					}
-				}
-				// inContactedList := false
-				// for _, val := range ContactedList {
-				// 	if val.contact.NodeID.Equals(res.Receiver.NodeID) {
-				// 		if res.Err != nil {
-				// 			val.status = 1
-				// 		} else {
-				// 			val.status = 2
-				// 		}
-				// 		inContactedList = true
-				// 	}
-				// }
-				// if !inContactedList {
-				// 	one_shortlist_element := ShortListElement{res.Receiver, 159 - id.Xor(res.Receiver.NodeID).PrefixLen(), 0}
-				// 	if res.Err != nil {
-				// 		one_shortlist_element.status = 1
-				// 	} else {
-				// 		one_shortlist_element.status = 2
-				// 	}
-				// 	ContactedList = append(ContactedList, one_shortlist_element)
-				// }
-				if res.Err == nil {
-					for _, val := range res.Nodes {
-						one_shortlist_element := ShortListElement{val, 159 - id.Xor(val.NodeID).PrefixLen(), 0, false}
-						if notInList(ShortList, one_shortlist_element) && notInList(ProbingList, one_shortlist_element) && notInList(ContactedList, one_shortlist_element) {
-							ShortList = append(ShortList, one_shortlist_element)
-						}
-					}
-				}
-				if len(ProbingList) == 0 {
-					allreceive = true
-				}
-			case timeout = <-timeOutChan:
-				for _, probingval := range ProbingList {
-					// inContactedList := false
-					// for _, contactedval := range ContactedList {
-					// 	if probingval.contact.NodeID.Equals(contactedval.contact.NodeID) {
-					// 		contactedval.status = 1
-					// 		inContactedList = true
-					// 	}
-					// }
-					// if !inContactedList {
-					probingval.status = 1
-					ContactedList = append(ContactedList, probingval)
-					// }
-				}
-			}
-		}
-		sort.Sort(ShortListElements(ShortList))
-	}
-
-	ResultList := make([]Contact, 0, 30)
-	sort.Sort(ShortListElements(ContactedList))
-	for _, val := range ContactedList {
-		if val.status == 2 {
-			ResultList = append(ResultList, val.contact)
-		}
-	}
-	if len(ResultList) > 20 {
-		ResultList = ResultList[:20]
-	}
-	return ResultList, nil
-	//return nil, &CommandFailed{"Not implemented"}
+	k.publish(key, value, ttl)
+	return k.iterativeStore(ctx, key, value, ttl)
 }
 
-func (k *Kademlia) DoIterativeStore(key ID, value []byte) ([]Contact, error) {
-	contacts, _ := k.DoIterativeFindNode(key)
+// iterativeStore stores a value on the K closest nodes to key without
+// taking charge of republishing it.
+func (k *Kademlia) iterativeStore(ctx context.Context, key ID, value []byte, ttl time.Duration) ([]Contact, error) {
+	contacts, err := k.DoIterativeFindNodeContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	ResultList := make([]Contact, 0, 30)
 	for _, con := range contacts {
-		errormsg := k.DoStore(&con, key, value)
+		errormsg := k.DoStoreTTLContext(ctx, &con, key, value, ttl)
 		if errormsg == nil {
 			ResultList = append(ResultList, con)
 		}
 	}
+	if err := ctx.Err(); err != nil {
+		return ResultList, err
+	}
 	return ResultList, nil
-	//return nil, &CommandFailed{"Not implemented"}
 }
 func (k *Kademlia) DoIterativeFindValue(key ID) (value []byte, err error) {
-	ShortList := make([]ShortListElement, 0, 60)
-	ProbingList := make([]ShortListElement, 0, 3)
-	ContactedList := make([]ShortListElement, 0, 30)
-	iterFindValueChan := make(chan IterFindValueResult, 3)
-
-	initial_shortlist := k.FindClosest(key)
-	for _, val := range initial_shortlist {
-		one_shortlist_element := ShortListElement{val, 159 - key.Xor(val.NodeID).PrefixLen(), 0, false}
-		ShortList = append(ShortList, one_shortlist_element)
-	}
-	sort.Sort(ShortListElements(ShortList))
-
-	ClosestDistancePre := 160
-	ClosestDistanceNow := 159
-	if len(ShortList) > 0 {
-		ClosestDistanceNow = ShortList[0].distance
-	}
-	valueFound := false
-	var finalValue []byte = nil
-
-	for (ClosestDistanceNow < ClosestDistancePre) && NotEnoughActive(ContactedList) && (!valueFound) {
-		ClosestDistancePre = ClosestDistanceNow
-		ProbingList = nil
-		//dump(ProbingList)
-		i := 0
-		for i < alpha && i < len(ShortList) {
-			ProbingList = append(ProbingList, ShortList[i])
-			i++
-		}
-		ShortList = append(ShortList[:0], ShortList[i:]...)
-		timeout := false
-		timeOutChan := make(chan bool)
-		//valueFoundChan := make(chan bool)
-		//finalValueChan := make(chan []byte)
-		go func() {
-			time.Sleep(300 * time.Millisecond)
-			timeOutChan <- true
-		}()
-
-		for _, val := range ProbingList {
-			go k.iterFindValueHelper(val, key, iterFindValueChan)
-		}
-		allreceive := false
-		for !timeout && !allreceive {
-			select {
-			case res := <-iterFindValueChan:
-				//fmt.Println("I received something:", res.val)
-				for index, val := range ProbingList {
-					if val.contact.NodeID.Equals(res.receiver.NodeID) {
-						ProbingList = append(ProbingList[:index], ProbingList[index+1:]...)
-						one_shortlist_element := ShortListElement{res.receiver, 159 - key.Xor(res.receiver.NodeID).PrefixLen(), 0, false}
-						if res.err != nil {
-							one_shortlist_element.status = 1
-						} else {
-							one_shortlist_element.status = 2
-						}
-						if res.val != nil {
-							one_shortlist_element.hasValue = true
-							valueFound = true
-							finalValue = res.val
-							//fmt.Println("final Value is :", finalValue)
-						} else {
-							one_shortlist_element.hasValue = false
-							//fmt.Println("didn't find value")
-							//fmt.Println("finalValue is:", finalValue)
-						}
-						ContactedList = append(ContactedList, one_shortlist_element)
-					}
-				}
-
-				if res.err == nil {
-					for _, val := range res.contacts {
-						one_shortlist_element := ShortListElement{val, 159 - key.Xor(val.NodeID).PrefixLen(), 0, false}
-						if notInList(ShortList, one_shortlist_element) && notInList(ProbingList, one_shortlist_element) && notInList(ContactedList, one_shortlist_element) {
-							ShortList = append(ShortList, one_shortlist_element)
-						}
-					}
-				}
-				if len(ProbingList) == 0 {
-					allreceive = true
-					//fmt.Println("All received")
-				}
+	return k.DoIterativeFindValueContext(context.Background(), key)
+}
+func (k *Kademlia) DoIterativeFindValueContext(ctx context.Context, key ID) (value []byte, err error) {
+	return k.iterativeFindValue(ctx, key, false, nil)
+}
 
-			case timeout = <-timeOutChan:
-				//fmt.Println("timeout!!!!!!")
-				for _, probingval := range ProbingList {
-					probingval.status = 1
-					probingval.hasValue = false
-					ContactedList = append(ContactedList, probingval)
-				}
-			}
+// iterativeFindValue looks up the value stored under key. If verify is set,
+// key must be the value's content ID; a node answering with any other value
+// is penalised and the lookup carries on as if it had not answered. If only
+// such values turn up, the lookup fails with a *CorruptValueError.
+func (k *Kademlia) iterativeFindValue(ctx context.Context, key ID, verify bool, trace *LookupTrace) (value []byte, err error) {
+	var corrupt int32
+	query := func(ctx context.Context, contact *Contact) (res lookupResponse) {
+		res.value, res.ttl, res.contacts, res.err = k.findValue(ctx, contact, key)
+		if verify && res.value != nil && !ContentID(res.value, k.config.IDBits).Equals(key) {
+			atomic.StoreInt32(&corrupt, 1)
+			k.penalize(contact)
+			res.value, res.contacts, res.err = nil, nil, &CorruptValueError{key}
+		}
+		return
+	}
+	stop := func(res *lookupResponse) bool {
+		return res.value != nil
+	}
+	ShortList, found, err := k.lookup(ctx, key, query, stop, trace)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		if atomic.LoadInt32(&corrupt) != 0 {
+			return nil, &CorruptValueError{key}
 		}
-		sort.Sort(ShortListElements(ShortList))
-		if len(ShortList) > 0 {
-			ClosestDistanceNow = ShortList[0].distance
+		closest := ShortList.closestActive(1)
+		if len(closest) == 0 {
+			return nil, &ValueNotFoundError{key}
 		}
+		return nil, &ValueNotFoundError{closest[0].NodeID}
 	}
-	sort.Sort(ShortListElements(ContactedList))
-	close(iterFindValueChan)
-
-	if valueFound {
-		//fmt.Println("I found value1: !", finalValue)
-		for _, con := range ContactedList {
-			if con.status == 2 && !con.hasValue {
-				k.DoStore(&con.contact, key, finalValue)
-				return finalValue, nil
-			}
+	// Cache the value on the closest node that answered without it, for no
+	// longer than the node that had it will keep it.
+	for _, con := range ShortList {
+		if found.ttl <= 0 {
+			break
+		}
+		if con.status == 2 && !con.hasValue {
+			k.DoStoreTTLContext(ctx, &con.contact, key, found.value, found.ttl)
+			break
 		}
-		return finalValue, nil
-	} else {
-		//fmt.Println("Did I enter this condition1?")
-		return nil, &ValueNotFoundError{ContactedList[0].contact.NodeID}
 	}
-	return nil, &ValueNotFoundError{ContactedList[0].contact.NodeID}
-	//return nil, &CommandFailed{"Not implemented"}
+	return found.value, nil
 }
 
 // For project 3!
 func (k *Kademlia) Vanish(data []byte, numberKeys byte,
 	threshold byte, timeoutSeconds int) (vdo VanashingDataObject) {
-	vdo = k.VanishData(data, numberKeys, threshold, timeoutSeconds)
+	vdo, _ = k.VanishContext(context.Background(), data, numberKeys, threshold, timeoutSeconds)
+	return
+}
+
+func (k *Kademlia) VanishContext(ctx context.Context, data []byte, numberKeys byte,
+	threshold byte, timeoutSeconds int) (vdo VanashingDataObject, err error) {
+	vdo, err = k.vanishData(ctx, data, numberKeys, threshold, timeoutSeconds)
+	if err != nil {
+		return
+	}
 	id := NewRandomID()
 	k.VdoMutexLock.Lock()
 	k.Vdos[id] = vdo
@@ -881,63 +1007,48 @@ func (k *Kademlia) Vanish(data []byte, numberKeys byte,
 }
 
 func (k *Kademlia) Unvanish(nodeID ID, vdoID ID) (data []byte) {
-	data = nil
-	vdo := k.GetVDOHelper(nodeID, vdoID)
-	data = k.UnvanishData(vdo)
+	data, _ = k.UnvanishContext(context.Background(), nodeID, vdoID)
 	return
 }
 
+func (k *Kademlia) UnvanishContext(ctx context.Context, nodeID ID, vdoID ID) (data []byte, err error) {
+	vdo, err := k.getVDOHelper(ctx, nodeID, vdoID)
+	if err != nil {
+		return nil, err
+	}
+	return k.unvanishData(ctx, vdo)
+}
+
 func (k *Kademlia) GetVDOHelper(nodeID ID, vdoID ID) (vdo VanashingDataObject) {
+	vdo, _ = k.getVDOHelper(context.Background(), nodeID, vdoID)
+	return
+}
+
+func (k *Kademlia) getVDOHelper(ctx context.Context, nodeID ID, vdoID ID) (vdo VanashingDataObject, err error) {
 	localcontact, localerr := k.FindContact(nodeID)
 	if localerr == nil {
-		addr := fmt.Sprintf("%s:%d", (*localcontact).Host.String(), (*localcontact).Port)
-		port_str := strconv.Itoa(int((*localcontact).Port))
-		path := rpc.DefaultRPCPath + port_str
-		client, err := rpc.DialHTTPPath(
-			"tcp",
-			addr,
-			path,
-		)
-		if err != nil {
-			return
-		}
-		defer client.Close()
-		req := GetVDORequest{k.SelfContact, NewRandomID(), vdoID}
-		var res GetVDOResult
-		err = client.Call("KademliaRPC.GetVDO", req, &res)
+		return k.getVDO(ctx, localcontact, vdoID)
+	} else {
+		contacts, err := k.DoIterativeFindNodeContext(ctx, nodeID)
 		if err != nil {
-			fmt.Println("Err: " + err.Error())
-			return
-		} else {
-			return res.VDO
+			return vdo, err
 		}
-	} else {
-		contacts, _ := k.DoIterativeFindNode(nodeID)
 		for _, con := range contacts {
 			if con.NodeID.Equals(nodeID) {
-				addr := fmt.Sprintf("%s:%d", con.Host.String(), con.Port)
-				port_str := strconv.Itoa(int(con.Port))
-				path := rpc.DefaultRPCPath + port_str
-				client, err := rpc.DialHTTPPath(
-					"tcp",
-					addr,
-					path,
-				)
-				if err != nil {
-					return
-				}
-				defer client.Close()
-				req := GetVDORequest{k.SelfContact, NewRandomID(), vdoID}
-				var res GetVDOResult
-				err = client.Call("KademliaRPC.GetVDO", req, &res)
-				if err != nil {
-					fmt.Println("Err: " + err.Error())
-					return
-				} else {
-					return res.VDO
-				}
+				return k.getVDO(ctx, &con, vdoID)
 			}
 		}
 	}
-	return
+	return vdo, localerr
+}
+
+func (k *Kademlia) getVDO(ctx context.Context, contact *Contact, vdoID ID) (vdo VanashingDataObject, err error) {
+	req := GetVDORequest{k.SelfContact, vdoID, NewRandomID()}
+	var res GetVDOResult
+	err = k.call(ctx, contact, "KademliaRPC.GetVDO", req, &res)
+	if err != nil {
+		fmt.Println("Err: " + err.Error())
+		return
+	}
+	return res.VDO, nil
 }
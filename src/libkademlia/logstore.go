@@ -0,0 +1,370 @@
+package libkademlia
+
+// Contains a Store that keeps values in an append-only log file, so they
+// outlive the node and need not fit in memory.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	logRecordPut    = 1
+	logRecordDelete = 2
+	// A record is a header, the value and a CRC-32 of both. The header
+	// holds the record type, the key, the sender, the received and expiry
+	// times in nanoseconds since the epoch, the length of the value and a
+	// CRC-32 of the header itself, so a damaged length is caught before
+	// it is used.
+	logHeaderSize = 1 + 2*MaxIDBytes + 8 + 8 + 4 + logCRCSize
+	logCRCSize    = 4
+	// maxLogValueSize bounds the values a LogStore holds, so a damaged
+	// length field cannot make it allocate without limit.
+	maxLogValueSize = 64 << 20
+	// Compaction waits until at least this many bytes of the log are
+	// overwritten or deleted records.
+	defaultLogMinGarbage = 1 << 20
+)
+
+// LogStore appends every Put and Delete to a log file and keeps only the
+// offset of each live value in memory. Once more of the log is garbage than
+// live data, it rewrites the log with just the live values. Writes are not
+// synced until Close, so a crash may lose the latest ones; a torn record at
+// the end of the log is dropped when the log is opened again. A Put or
+// Delete that was written succeeds even if the compaction after it fails;
+// the compaction is tried again on the next write, and Close reports the
+// failure if none has succeeded since.
+type LogStore struct {
+	path  string
+	file  *os.File
+	index map[ID]logEntry
+	// size is the length of the log and live the bytes of it taken up by
+	// records still in the index.
+	size       int64
+	live       int64
+	minGarbage int64
+	// compactErr is the error of the last compaction, if it failed.
+	compactErr error
+}
+
+// logEntry locates the latest record for a key.
+type logEntry struct {
+	offset int64
+	length int
+}
+
+func (e logEntry) recordSize() int64 {
+	return int64(logHeaderSize + e.length + logCRCSize)
+}
+
+// OpenLogStore opens the log at path, creating it if it does not exist. It
+// fails with a *StoreError if the log cannot be read or is damaged anywhere
+// but in its last record.
+func OpenLogStore(path string) (*LogStore, error) {
+	s := new(LogStore)
+	s.path = path
+	s.minGarbage = defaultLogMinGarbage
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the log and rebuilds the index from it.
+func (s *LogStore) open() error {
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return &StoreError{s.path, err}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return &StoreError{s.path, err}
+	}
+	s.file = file
+	s.index = make(map[ID]logEntry)
+	s.size = 0
+	s.live = 0
+	r := bufio.NewReader(file)
+	for {
+		key, kind, _, length, err := readLogRecord(r)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF || err == errLogChecksum || err == errLogHeader {
+			torn, tornErr := s.tornAt(err, length, info.Size())
+			if tornErr == nil && !torn {
+				tornErr = &CommandFailed{fmt.Sprintf("record at offset %d: %s", s.size, err)}
+			}
+			if tornErr != nil {
+				file.Close()
+				return &StoreError{s.path, tornErr}
+			}
+			// The last write was cut short; drop what there is of it.
+			if err := file.Truncate(s.size); err != nil {
+				file.Close()
+				return &StoreError{s.path, err}
+			}
+			break
+		} else if err != nil {
+			file.Close()
+			return &StoreError{s.path, err}
+		}
+		entry := logEntry{s.size, length}
+		s.size += entry.recordSize()
+		if old, ok := s.index[key]; ok {
+			s.live -= old.recordSize()
+			delete(s.index, key)
+		}
+		if kind == logRecordPut {
+			s.index[key] = entry
+			s.live += entry.recordSize()
+		}
+	}
+	return nil
+}
+
+// tornAt reports whether the damaged record at s.size, which readLogRecord
+// failed with err, is the last write cut short: one running past the end
+// of the log, or followed by nothing but zeros up to it, which is what a
+// crash leaves where the file grew before the data reached the disk. Where
+// the header is damaged, the zeros must start with the record.
+func (s *LogStore) tornAt(err error, length int, end int64) (bool, error) {
+	if err == io.ErrUnexpectedEOF {
+		return true, nil
+	}
+	start := s.size
+	if err == errLogChecksum {
+		start += logEntry{s.size, length}.recordSize()
+	}
+	if start > end {
+		return true, nil
+	}
+	rest := bufio.NewReader(io.NewSectionReader(s.file, start, end-start))
+	for {
+		b, err := rest.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		} else if b != 0 {
+			return false, nil
+		}
+	}
+}
+
+func (s *LogStore) Get(key ID) (StoredValue, bool, error) {
+	entry, ok := s.index[key]
+	if !ok {
+		return StoredValue{}, false, nil
+	}
+	record := make([]byte, entry.recordSize())
+	if _, err := s.file.ReadAt(record, entry.offset); err != nil {
+		return StoredValue{}, false, &StoreError{s.path, err}
+	}
+	_, _, value, _, err := readLogRecord(bytes.NewReader(record))
+	if err != nil {
+		return StoredValue{}, false, &StoreError{s.path, err}
+	}
+	return value, true, nil
+}
+
+func (s *LogStore) Put(key ID, value StoredValue) error {
+	if len(value.Value) > maxLogValueSize {
+		return &StoreError{s.path, &CommandFailed{"value too large"}}
+	}
+	entry := logEntry{s.size, len(value.Value)}
+	if err := s.append(logRecordPut, key, value); err != nil {
+		return err
+	}
+	if old, ok := s.index[key]; ok {
+		s.live -= old.recordSize()
+	}
+	s.index[key] = entry
+	s.live += entry.recordSize()
+	s.maybeCompact()
+	return nil
+}
+
+func (s *LogStore) Delete(key ID) error {
+	old, ok := s.index[key]
+	if !ok {
+		return nil
+	}
+	if err := s.append(logRecordDelete, key, StoredValue{}); err != nil {
+		return err
+	}
+	delete(s.index, key)
+	s.live -= old.recordSize()
+	s.maybeCompact()
+	return nil
+}
+
+func (s *LogStore) Iterate(fn func(key ID, value StoredValue) bool) error {
+	for key := range s.index {
+		value, _, err := s.Get(key)
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *LogStore) Close() error {
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return &StoreError{s.path, err}
+	}
+	if err := s.file.Close(); err != nil {
+		return &StoreError{s.path, err}
+	}
+	return s.compactErr
+}
+
+// append writes a record to the end of the log.
+func (s *LogStore) append(kind byte, key ID, value StoredValue) error {
+	record := encodeLogRecord(kind, key, value)
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return &StoreError{s.path, err}
+	}
+	s.size += int64(len(record))
+	return nil
+}
+
+// maybeCompact compacts the log once enough of it is garbage, and keeps the
+// error of the compaction in compactErr.
+func (s *LogStore) maybeCompact() {
+	garbage := s.size - s.live
+	if garbage < s.minGarbage || garbage <= s.live {
+		return
+	}
+	s.compactErr = s.Compact()
+}
+
+// Compact rewrites the log with only the latest record of each live key.
+// The new log replaces the old one in a single rename, so a crash leaves
+// one or the other.
+func (s *LogStore) Compact() error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return &StoreError{s.path, err}
+	}
+	w := bufio.NewWriter(tmp)
+	for _, entry := range s.index {
+		record := make([]byte, entry.recordSize())
+		if _, err = s.file.ReadAt(record, entry.offset); err != nil {
+			break
+		}
+		if _, err = w.Write(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return &StoreError{s.path, err}
+	}
+	s.file.Close()
+	return s.open()
+}
+
+var (
+	errLogChecksum = &CommandFailed{"log record checksum mismatch"}
+	errLogHeader   = &CommandFailed{"log record header damaged"}
+)
+
+func encodeLogRecord(kind byte, key ID, value StoredValue) []byte {
+	record := make([]byte, logHeaderSize+len(value.Value)+logCRCSize)
+	record[0] = kind
+	copy(record[1:], key[:])
+	copy(record[1+MaxIDBytes:], value.Sender[:])
+	times := record[1+2*MaxIDBytes:]
+	binary.BigEndian.PutUint64(times, uint64(encodeLogTime(value.Received)))
+	binary.BigEndian.PutUint64(times[8:], uint64(encodeLogTime(value.Expires)))
+	binary.BigEndian.PutUint32(times[16:], uint32(len(value.Value)))
+	headerCRC := crc32.ChecksumIEEE(record[:logHeaderSize-logCRCSize])
+	binary.BigEndian.PutUint32(record[logHeaderSize-logCRCSize:], headerCRC)
+	copy(record[logHeaderSize:], value.Value)
+	crc := crc32.ChecksumIEEE(record[:logHeaderSize+len(value.Value)])
+	binary.BigEndian.PutUint32(record[logHeaderSize+len(value.Value):], crc)
+	return record
+}
+
+// readLogRecord reads the next record from r. It returns io.EOF if r is at
+// the end of the log, io.ErrUnexpectedEOF if the record is incomplete, and
+// errLogHeader or errLogChecksum if its header or the rest of it is
+// damaged. The length is only set once the header has been checked.
+func readLogRecord(r io.Reader) (key ID, kind byte, value StoredValue, length int, err error) {
+	header := make([]byte, logHeaderSize)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	headerCRC := crc32.ChecksumIEEE(header[:logHeaderSize-logCRCSize])
+	if headerCRC != binary.BigEndian.Uint32(header[logHeaderSize-logCRCSize:]) {
+		err = errLogHeader
+		return
+	}
+	kind = header[0]
+	copy(key[:], header[1:1+MaxIDBytes])
+	copy(value.Sender[:], header[1+MaxIDBytes:1+2*MaxIDBytes])
+	times := header[1+2*MaxIDBytes:]
+	value.Received = decodeLogTime(int64(binary.BigEndian.Uint64(times)))
+	value.Expires = decodeLogTime(int64(binary.BigEndian.Uint64(times[8:])))
+	length = int(binary.BigEndian.Uint32(times[16:]))
+	if length > maxLogValueSize || (kind != logRecordPut && kind != logRecordDelete) {
+		length = 0
+		err = errLogHeader
+		return
+	}
+	rest := make([]byte, length+logCRCSize)
+	if _, err = io.ReadFull(r, rest); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	crc := crc32.ChecksumIEEE(header)
+	crc = crc32.Update(crc, crc32.IEEETable, rest[:length])
+	if crc != binary.BigEndian.Uint32(rest[length:]) {
+		err = errLogChecksum
+		return
+	}
+	value.Value = rest[:length]
+	return
+}
+
+// encodeLogTime and decodeLogTime keep the zero time distinct from the
+// epoch.
+func encodeLogTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func decodeLogTime(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,199 @@
+package libkademlia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogStoreReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, valuesFile)
+	s, err := OpenLogStore(path)
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	kept, deleted := NewRandomID(), NewRandomID()
+	sender, received := NewRandomID(), time.Now()
+	s.Put(kept, StoredValue{[]byte("kept"), sender, received, time.Time{}})
+	s.Put(deleted, StoredValue{[]byte("deleted"), sender, received, time.Time{}})
+	s.Delete(deleted)
+	if err := s.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+
+	// A write cut short by a crash leaves part of a record at the end.
+	record := encodeLogRecord(logRecordPut, NewRandomID(), StoredValue{Value: []byte("torn")})
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(record[:len(record)-3])
+	f.Close()
+
+	s, err = OpenLogStore(path)
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	value, ok, err := s.Get(kept)
+	if !ok || err != nil || string(value.Value) != "kept" {
+		t.Error("Value lost on reopening: ", err)
+	}
+	if !value.Sender.Equals(sender) || !value.Received.Equal(received) || !value.Expires.IsZero() {
+		t.Error("Sender or times not kept: ", value.Sender.AsString(), value.Received, value.Expires)
+	}
+	if _, ok, _ := s.Get(deleted); ok {
+		t.Error("Deleted value back after reopening")
+	}
+	if len(s.index) != 1 {
+		t.Error("Torn record not dropped")
+	}
+	// Writes after the torn record must survive another reopen.
+	later := NewRandomID()
+	s.Put(later, StoredValue{Value: []byte("later")})
+	s.Close()
+	s, _ = OpenLogStore(path)
+	defer s.Close()
+	if _, ok, _ := s.Get(later); !ok {
+		t.Error("Value written after a torn record lost")
+	}
+}
+
+func TestLogStoreCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, valuesFile)
+	s, err := OpenLogStore(path)
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	s.minGarbage = 4096
+	keys := []ID{NewRandomID(), NewRandomID(), NewRandomID()}
+	value := make([]byte, 100)
+	for i := 0; i < 200; i++ {
+		value[0] = byte(i)
+		if err := s.Put(keys[i%len(keys)], StoredValue{Value: value}); err != nil {
+			t.Fatal("Put failed: ", err)
+		}
+	}
+	s.Delete(keys[2])
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 2*s.minGarbage {
+		t.Error("Log not compacted: ", info.Size(), " bytes")
+	}
+	if info.Size() != s.size {
+		t.Error("Log is ", info.Size(), " bytes, store thinks ", s.size)
+	}
+	s.Close()
+	s, err = OpenLogStore(path)
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	defer s.Close()
+	for i, key := range keys[:2] {
+		got, ok, _ := s.Get(key)
+		if !ok || got.Value[0] != byte(198+i) {
+			t.Error("Latest value of key ", i, " lost in compaction")
+		}
+	}
+	if _, ok, _ := s.Get(keys[2]); ok {
+		t.Error("Deleted value back after compaction")
+	}
+}
+
+func TestLogStoreDamage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, valuesFile)
+	s, err := OpenLogStore(path)
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	for i := 0; i < 10; i++ {
+		s.Put(NewRandomID(), StoredValue{Value: []byte("value")})
+	}
+	s.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage in the first record, in its value or its length, is not a
+	// torn write and must leave the log alone.
+	for _, offset := range []int64{logHeaderSize, logHeaderSize - logCRCSize - 1} {
+		f, _ := os.OpenFile(path, os.O_RDWR, 0644)
+		b := make([]byte, 1)
+		f.ReadAt(b, offset)
+		b[0] ^= 0xff
+		f.WriteAt(b, offset)
+		_, err := OpenLogStore(path)
+		if _, ok := err.(*StoreError); !ok {
+			t.Error("Expected StoreError for damage at offset ", offset, ", got ", err)
+		}
+		if after, _ := os.Stat(path); after.Size() != info.Size() {
+			t.Error("Damaged log truncated to ", after.Size(), " bytes")
+		}
+		b[0] ^= 0xff
+		f.WriteAt(b, offset)
+		f.Close()
+	}
+
+	// A crash can leave the log grown by zeros the last write never
+	// filled in.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(make([]byte, 100))
+	f.Close()
+	s, err = OpenLogStore(path)
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	defer s.Close()
+	if len(s.index) != 10 || s.size != info.Size() {
+		t.Error("Zeros at the end of the log not dropped")
+	}
+}
+
+func TestLogStoreCompactionFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, valuesFile)
+	s, err := OpenLogStore(path)
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	s.minGarbage = 1
+	// Compaction cannot create its temporary file where a directory is.
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	key := NewRandomID()
+	s.Put(key, StoredValue{Value: []byte("old")})
+	if err := s.Put(key, StoredValue{Value: []byte("new")}); err != nil {
+		t.Error("Put failed with its compaction: ", err)
+	}
+	if err := s.Delete(key); err != nil {
+		t.Error("Delete failed with its compaction: ", err)
+	}
+	if _, ok, _ := s.Get(key); ok {
+		t.Error("Deleted value still in the store")
+	}
+	if _, ok := s.Close().(*StoreError); !ok {
+		t.Error("Close did not report the failed compaction")
+	}
+}
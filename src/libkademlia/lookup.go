@@ -0,0 +1,334 @@
+package libkademlia
+
+// Contains the iterative lookup that DoIterativeFindNode, DoIterativeFindValue
+// and everything built on them share, following section 2.3 of the Kademlia
+// paper.
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A lookupQuery asks one node about the lookup's target.
+type lookupQuery func(ctx context.Context, contact *Contact) lookupResponse
+
+// lookupResponse is what a node answered to a lookupQuery.
+type lookupResponse struct {
+	contact  Contact
+	contacts []Contact
+	value    []byte
+	ttl      time.Duration
+	err      error
+	latency  time.Duration
+}
+
+// lookup searches for the nodes closest to target. Each round queries the
+// Alpha closest nodes not yet queried, or all of the K closest if the
+// previous round found nobody closer, and the lookup ends once the K closest
+// nodes that did not fail have all answered. If stop returns true for a
+// response, the lookup ends early with that response. The shortlist starts
+// out with the K closest contacts in the routing table; if some fail and
+// fewer than K are left, the rest of the table joins it, so that others are
+// there to take their place.
+//
+// With more than one DisjointPaths, the closest known nodes are dealt out
+// between that many paths, which run in parallel and never query a node
+// another path has queried. Their results are merged at the end.
+//
+// lookup returns every node it heard of, sorted by distance to target, with
+// the status of each: 0 if it was never queried, 1 if it failed to answer
+// and 2 if it answered. If trace is not nil, the rounds and RPCs of the
+// lookup are recorded in it.
+func (k *Kademlia) lookup(ctx context.Context, target ID, query lookupQuery, stop func(*lookupResponse) bool, trace *LookupTrace) (ShortListElements, *lookupResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	k.touchBucket(target)
+	if trace != nil {
+		start := time.Now()
+		defer func() {
+			trace.Duration = time.Since(start)
+		}()
+	}
+
+	start := k.FindClosest(target)
+	paths := k.config.DisjointPaths
+	if paths == 1 {
+		return k.lookupPath(ctx, target, start, query, stop, nil, trace)
+	}
+
+	var mu sync.Mutex
+	claimed := make(map[ID]int)
+	type pathResult struct {
+		path      int
+		ShortList ShortListElements
+		found     *lookupResponse
+		err       error
+		trace     *LookupTrace
+	}
+	resChan := make(chan pathResult, paths)
+	for path := 0; path < paths; path++ {
+		var pathStart []Contact
+		for i := path; i < len(start); i += paths {
+			pathStart = append(pathStart, start[i])
+		}
+		claim := func(path int) func(ID) bool {
+			return func(id ID) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				owner, ok := claimed[id]
+				if !ok {
+					claimed[id] = path
+					return true
+				}
+				return owner == path
+			}
+		}(path)
+		res := pathResult{path: path}
+		if trace != nil {
+			res.trace = &LookupTrace{Target: target}
+		}
+		go func(res pathResult) {
+			res.ShortList, res.found, res.err = k.lookupPath(ctx, target, pathStart, query, stop, claim, res.trace)
+			resChan <- res
+		}(res)
+	}
+
+	results := make([]pathResult, paths)
+	var found *lookupResponse
+	var err error
+	for range results {
+		res := <-resChan
+		results[res.path] = res
+		if res.found != nil && found == nil {
+			found = res.found
+			// The other paths have nothing left to find.
+			cancel()
+		}
+		if res.err != nil && err == nil {
+			err = res.err
+		}
+	}
+	lists := make([]ShortListElements, paths)
+	for path, res := range results {
+		lists[path] = res.ShortList
+		if trace != nil {
+			for _, round := range res.trace.Rounds {
+				round.Path = path
+				trace.Rounds = append(trace.Rounds, round)
+			}
+		}
+	}
+	if found != nil {
+		return mergeShortLists(lists), found, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return mergeShortLists(lists), nil, nil
+}
+
+// lookupPath runs a single path of a lookup, starting from the contacts in
+// start. If claim is not nil, a node is only queried if claim returns true
+// for it; nodes it refuses are dropped from the shortlist.
+func (k *Kademlia) lookupPath(ctx context.Context, target ID, start []Contact, query lookupQuery, stop func(*lookupResponse) bool, claim func(ID) bool, trace *LookupTrace) (ShortListElements, *lookupResponse, error) {
+	var ShortList ShortListElements
+	seen := make(map[ID]bool)
+	add := func(c Contact) {
+		if seen[c.NodeID] || c.NodeID.Equals(k.NodeID) {
+			return
+		}
+		seen[c.NodeID] = true
+		ShortList = append(ShortList, ShortListElement{c, target.DistanceTo(c.NodeID), 0, false})
+	}
+	for _, c := range start {
+		add(c)
+	}
+	sort.Sort(ShortList)
+
+	// next picks the nodes to query in the coming round.
+	next := func(limit int) []int {
+		for {
+			ProbingList := ShortList.toQuery(k.config.K, limit)
+			if claim == nil {
+				return ProbingList
+			}
+			lost := make(map[int]bool)
+			for _, i := range ProbingList {
+				if !claim(ShortList[i].contact.NodeID) {
+					lost[i] = true
+				}
+			}
+			if len(lost) == 0 {
+				return ProbingList
+			}
+			kept := ShortList[:0]
+			for i, val := range ShortList {
+				if !lost[i] {
+					kept = append(kept, val)
+				}
+			}
+			ShortList = kept
+		}
+	}
+
+	// widen adds the rest of the routing table to the shortlist once nodes
+	// have failed and fewer than K are left, which it only does once.
+	widened := false
+	widen := func() {
+		live, failed := 0, 0
+		for _, val := range ShortList {
+			if val.status == 1 {
+				failed++
+			} else {
+				live++
+			}
+		}
+		if widened || failed == 0 || live >= k.config.K {
+			return
+		}
+		widened = true
+		table := k.copyTable()
+		for _, c := range table.GetContacts() {
+			add(c)
+		}
+		sort.Sort(ShortList)
+	}
+
+	resChan := make(chan lookupResponse)
+	closest := MaxDistance
+	improved := true
+	for {
+		widen()
+		limit := k.config.Alpha
+		if !improved {
+			limit = k.config.K
+		}
+		ProbingList := next(limit)
+		if len(ProbingList) == 0 {
+			break
+		}
+		var round *TraceRound
+		if trace != nil {
+			trace.Rounds = append(trace.Rounds, TraceRound{})
+			round = &trace.Rounds[len(trace.Rounds)-1]
+		}
+		for _, i := range ProbingList {
+			if round != nil {
+				round.Queries = append(round.Queries, TraceQuery{Contact: ShortList[i].contact, Err: context.Canceled})
+			}
+			go func(contact Contact) {
+				start := time.Now()
+				res := query(ctx, &contact)
+				res.latency = time.Since(start)
+				res.contact = contact
+				select {
+				case resChan <- res:
+				case <-ctx.Done():
+				}
+			}(ShortList[i].contact)
+		}
+
+		for range ProbingList {
+			var res lookupResponse
+			select {
+			case res = <-resChan:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			if round != nil {
+				round.record(&res)
+			}
+			// Entries only get appended during a round, so indices hold.
+			for i := range ShortList {
+				if !ShortList[i].contact.NodeID.Equals(res.contact.NodeID) {
+					continue
+				}
+				if res.err != nil {
+					ShortList[i].status = 1
+				} else {
+					ShortList[i].status = 2
+					ShortList[i].hasValue = res.value != nil
+				}
+				break
+			}
+			if res.err != nil {
+				continue
+			}
+			for _, c := range res.contacts {
+				add(c)
+			}
+			if stop != nil && stop(&res) {
+				sort.Sort(ShortList)
+				return ShortList, &res, nil
+			}
+		}
+
+		sort.Sort(ShortList)
+		improved = false
+		for _, val := range ShortList {
+			if val.status != 1 {
+				improved = val.distance.Less(closest)
+				if improved {
+					closest = val.distance
+				}
+				break
+			}
+		}
+	}
+	return ShortList, nil, nil
+}
+
+// toQuery returns the indices of up to limit nodes still to be queried among
+// the size closest nodes of a sorted shortlist that have not failed.
+func (slice ShortListElements) toQuery(size int, limit int) []int {
+	var res []int
+	considered := 0
+	for i := 0; i < len(slice) && considered < size && len(res) < limit; i++ {
+		if slice[i].status == 1 {
+			continue
+		}
+		considered++
+		if slice[i].status == 0 {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// mergeShortLists combines the shortlists of the paths of a lookup into one
+// sorted shortlist. A node on several lists keeps the status of the path
+// that queried it.
+func mergeShortLists(lists []ShortListElements) ShortListElements {
+	var merged ShortListElements
+	index := make(map[ID]int)
+	for _, list := range lists {
+		for _, val := range list {
+			i, ok := index[val.contact.NodeID]
+			if !ok {
+				index[val.contact.NodeID] = len(merged)
+				merged = append(merged, val)
+			} else if val.status > merged[i].status {
+				merged[i] = val
+			}
+		}
+	}
+	sort.Sort(merged)
+	return merged
+}
+
+// closestActive returns the contacts of up to size nodes of a sorted
+// shortlist that answered.
+func (slice ShortListElements) closestActive(size int) []Contact {
+	res := make([]Contact, 0, size)
+	for _, val := range slice {
+		if len(res) == size {
+			break
+		}
+		if val.status == 2 {
+			res = append(res, val.contact)
+		}
+	}
+	return res
+}
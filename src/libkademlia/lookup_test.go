@@ -0,0 +1,227 @@
+package libkademlia
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// generateSmallKKademlia starts num nodes with a bucket size of 4 and IDs
+// drawn from seed. Each joins through the node started before it and two
+// more picked at random, so that the small buckets still cover the network.
+func generateSmallKKademlia(network *SimNetwork, num int, seed int64) []*Kademlia {
+	r := rand.New(rand.NewSource(seed))
+	nodes := make([]*Kademlia, 0, num)
+	for i := 0; i < num; i++ {
+		var id ID
+		r.Read(id[:IDBytes])
+		config := Config{NodeID: id, Transport: network.Transport(), K: 4, Alpha: 2}
+		instance, err := NewKademliaWithConfig(SimAddress(i), config)
+		if err != nil {
+			panic(err)
+		}
+		if i > 0 {
+			instance.Join([]string{SimAddress(i - 1), SimAddress(r.Intn(i)), SimAddress(r.Intn(i))})
+		}
+		nodes = append(nodes, instance)
+	}
+	return nodes
+}
+
+// trueClosest returns the IDs of the size live nodes closest to key.
+func trueClosest(nodes []*Kademlia, key ID, size int) []ID {
+	all := make(ShortListElements, 0, len(nodes))
+	for _, node := range nodes {
+		all = append(all, ShortListElement{node.SelfContact, key.DistanceTo(node.NodeID), 0, false})
+	}
+	sort.Sort(all)
+	ids := make([]ID, 0, size)
+	for _, val := range all[:size] {
+		ids = append(ids, val.contact.NodeID)
+	}
+	return ids
+}
+
+func TestLookupFindsClosest(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := generateSmallKKademlia(network, 80, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 20; i++ {
+		from := nodes[i]
+		var key ID
+		r.Read(key[:IDBytes])
+		contacts, err := from.DoIterativeFindNode(key)
+		if err != nil {
+			t.Fatal("DoIterativeFindNode Return Error: ", err)
+		}
+		// The node doing the lookup never returns itself.
+		var others []*Kademlia
+		for _, node := range nodes {
+			if node != from {
+				others = append(others, node)
+			}
+		}
+		want := trueClosest(others, key, 4)
+		if len(contacts) != len(want) {
+			t.Fatal("Expected ", len(want), " contacts, got ", len(contacts))
+		}
+		for j, c := range contacts {
+			if !c.NodeID.Equals(want[j]) {
+				t.Error("Contact ", j, " of lookup ", i, " is not the ", j, "th closest node")
+			}
+		}
+	}
+}
+
+func TestLookupSkipsDeadNodes(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.Timeout = 50 * time.Millisecond
+	nodes := generateSmallKKademlia(network, 60, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	live := make([]*Kademlia, 0, len(nodes))
+	for i, node := range nodes {
+		if i > 0 && i%3 == 0 {
+			node.Close()
+		} else {
+			live = append(live, node)
+		}
+	}
+	var key ID
+	rand.New(rand.NewSource(2)).Read(key[:IDBytes])
+	contacts, err := nodes[0].DoIterativeFindNode(key)
+	if err != nil {
+		t.Fatal("DoIterativeFindNode Return Error: ", err)
+	}
+	if len(contacts) != 4 {
+		t.Fatal("Expected 4 contacts, got ", len(contacts))
+	}
+	for _, c := range contacts {
+		alive := false
+		for _, node := range live {
+			if node.NodeID.Equals(c.NodeID) {
+				alive = true
+			}
+		}
+		if !alive {
+			t.Error("Lookup returned a dead node: ", c.NodeID.AsString())
+		}
+	}
+}
+
+func TestLookupWidensPastDeadContacts(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.Timeout = 50 * time.Millisecond
+	nodes := generateSmallKKademlia(network, 60, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	// Every contact the lookup starts from is dead, so only the rest of
+	// the routing table can take it further.
+	var key ID
+	rand.New(rand.NewSource(2)).Read(key[:IDBytes])
+	from := nodes[0]
+	dead := make(map[ID]bool)
+	for _, c := range from.FindClosest(key) {
+		dead[c.NodeID] = true
+	}
+	for _, node := range nodes {
+		if dead[node.NodeID] {
+			node.Close()
+		}
+	}
+
+	contacts, err := from.DoIterativeFindNode(key)
+	if err != nil {
+		t.Fatal("DoIterativeFindNode Return Error: ", err)
+	}
+	// The live nodes nearest the key may have known only the dead ones in
+	// their buckets, so which of them are found varies with how the
+	// network came together; that K of them are does not.
+	if len(contacts) != 4 {
+		t.Fatal("Expected 4 contacts, got ", len(contacts))
+	}
+	for _, c := range contacts {
+		if dead[c.NodeID] {
+			t.Error("Lookup returned a dead node: ", c.NodeID.AsString())
+		}
+	}
+}
+
+func TestDisjointPathsLookup(t *testing.T) {
+	network := NewSimNetwork(1)
+	// The IDs differ in their top four bits, so with buckets of 8 every
+	// node can know every other one. The K closest nodes to any key are
+	// then among those a lookup starts from, and dealing them out between
+	// the paths must not lose any of them.
+	r := rand.New(rand.NewSource(1))
+	nodes := make([]*Kademlia, 16)
+	for i := range nodes {
+		var id ID
+		r.Read(id[:IDBytes])
+		id[0] = id[0]&0x0f | byte(i<<4)
+		config := Config{NodeID: id, Transport: network.Transport(), K: 8, Alpha: 2, DisjointPaths: 3}
+		node, err := NewKademliaWithConfig(SimAddress(i), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = node
+	}
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	for i, node := range nodes {
+		for _, other := range nodes[i+1:] {
+			if _, err := node.DoPing(other.SelfContact.Host, other.SelfContact.Port); err != nil {
+				t.Fatal("DoPing Return Error: ", err)
+			}
+		}
+	}
+
+	from := nodes[0]
+	for i := 0; i < 10; i++ {
+		var key ID
+		r.Read(key[:IDBytes])
+		contacts, trace, err := from.DoIterativeFindNodeTrace(context.Background(), key)
+		if err != nil {
+			t.Fatal("DoIterativeFindNode Return Error: ", err)
+		}
+		want := trueClosest(nodes[1:], key, 8)
+		if len(contacts) != len(want) {
+			t.Fatal("Expected ", len(want), " contacts, got ", len(contacts))
+		}
+		for j, c := range contacts {
+			if !c.NodeID.Equals(want[j]) {
+				t.Error("Lookup ", i, " contact ", j, " is not the ", j, "th closest node")
+			}
+		}
+		queriedBy := make(map[ID]int)
+		for _, round := range trace.Rounds {
+			for _, q := range round.Queries {
+				if path, ok := queriedBy[q.Contact.NodeID]; ok && path != round.Path {
+					t.Error("Node ", q.Contact.NodeID.AsString(), " queried by paths ", path, " and ", round.Path)
+				}
+				queriedBy[q.Contact.NodeID] = round.Path
+			}
+		}
+	}
+
+	if _, err := NewKademliaWithConfig(SimAddress(len(nodes)), Config{Transport: network.Transport(), DisjointPaths: -1}); err == nil {
+		t.Error("Negative DisjointPaths accepted")
+	}
+}
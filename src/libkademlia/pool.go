@@ -0,0 +1,155 @@
+package libkademlia
+
+// Contains the cache of open RPC client connections shared by all outbound
+// calls of an HTTPTransport.
+
+import (
+	"context"
+	"io"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConns        = 64
+	defaultConnIdleTimeout = time.Minute
+)
+
+// clientPool keeps at most maxSize connections open, one per contact
+// address. Connections idle for longer than idleTimeout are closed, and a
+// connection that fails with anything but an error returned by the remote
+// method is dropped so the next call dials afresh.
+type clientPool struct {
+	mu          sync.Mutex
+	clients     map[string]*pooledClient
+	maxSize     int
+	idleTimeout time.Duration
+}
+
+type pooledClient struct {
+	addr     string
+	client   *rpc.Client
+	lastUsed time.Time
+	inUse    int
+	// removed is set once the client has left the pool; it is closed as
+	// soon as nobody is using it.
+	removed bool
+}
+
+func newClientPool(maxSize int, idleTimeout time.Duration) *clientPool {
+	p := new(clientPool)
+	p.clients = make(map[string]*pooledClient)
+	p.maxSize = maxSize
+	p.idleTimeout = idleTimeout
+	return p
+}
+
+// get returns a connection to addr, dialing one with dial if none is cached.
+// Every client returned by get must be handed back through put. reused
+// reports whether the connection had been used before.
+func (p *clientPool) get(addr string, dial func() (*rpc.Client, error)) (pc *pooledClient, reused bool, err error) {
+	p.mu.Lock()
+	p.expireLocked(time.Now())
+	if pc, ok := p.clients[addr]; ok {
+		pc.inUse++
+		p.mu.Unlock()
+		return pc, true, nil
+	}
+	p.mu.Unlock()
+
+	client, err := dial()
+	if err != nil {
+		return nil, false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if other, ok := p.clients[addr]; ok {
+		// Somebody else dialed the same contact meanwhile; keep theirs.
+		client.Close()
+		other.inUse++
+		return other, true, nil
+	}
+	pc = &pooledClient{addr: addr, client: client, lastUsed: time.Now(), inUse: 1}
+	p.clients[addr] = pc
+	p.evictLocked()
+	return pc, false, nil
+}
+
+// put hands a client back after a call that ended with err.
+func (p *clientPool) put(pc *pooledClient, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.inUse--
+	pc.lastUsed = time.Now()
+	if brokenConn(err) {
+		p.removeLocked(pc)
+	}
+	if pc.removed && pc.inUse == 0 {
+		pc.client.Close()
+	}
+}
+
+// Close closes every cached connection.
+func (p *clientPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.clients {
+		p.removeLocked(pc)
+		if pc.inUse == 0 {
+			pc.client.Close()
+		}
+	}
+}
+
+func (p *clientPool) removeLocked(pc *pooledClient) {
+	if p.clients[pc.addr] == pc {
+		delete(p.clients, pc.addr)
+	}
+	pc.removed = true
+}
+
+func (p *clientPool) expireLocked(now time.Time) {
+	for _, pc := range p.clients {
+		if pc.inUse == 0 && now.Sub(pc.lastUsed) > p.idleTimeout {
+			p.removeLocked(pc)
+			pc.client.Close()
+		}
+	}
+}
+
+// evictLocked drops the least recently used connections until the pool is
+// back within its size limit.
+func (p *clientPool) evictLocked() {
+	for len(p.clients) > p.maxSize {
+		var oldest *pooledClient
+		for _, pc := range p.clients {
+			if oldest == nil || pc.lastUsed.Before(oldest.lastUsed) {
+				oldest = pc
+			}
+		}
+		p.removeLocked(oldest)
+		if oldest.inUse == 0 {
+			oldest.client.Close()
+		}
+	}
+}
+
+// brokenConn reports whether err means the connection itself is unusable,
+// as opposed to the remote method having returned an error or the caller
+// having given up.
+func brokenConn(err error) bool {
+	if err == nil || err == context.Canceled || err == context.DeadlineExceeded {
+		return false
+	}
+	_, ok := err.(rpc.ServerError)
+	return !ok
+}
+
+// staleConn reports whether err is how a call fails on a connection the peer
+// has since closed. All Kademlia RPCs are idempotent, so such calls are
+// retried once on a fresh connection.
+func staleConn(err error) bool {
+	return err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF
+}
@@ -0,0 +1,66 @@
+package libkademlia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPoolReusesConnections(t *testing.T) {
+	transport := NewPooledHTTPTransport(1, time.Minute)
+	instance1 := NewKademliaWithTransport("localhost:9200", NewRandomID(), transport)
+	instance2 := NewKademlia("localhost:9201")
+	instance3 := NewKademlia("localhost:9202")
+	contact2 := instance2.SelfContact
+	contact3 := instance3.SelfContact
+
+	instance1.DoPing(contact2.Host, contact2.Port)
+	pc, reused, err := transport.pool.get(contactAddr(&contact2), nil)
+	if err != nil || !reused {
+		t.Error("Connection to instance 2 was not kept open")
+		return
+	}
+	transport.pool.put(pc, nil)
+	for i := 0; i < 10; i++ {
+		if _, err := instance1.DoFindNode(&contact2, NewRandomID()); err != nil {
+			t.Error("FindNode over pooled connection failed: ", err)
+		}
+	}
+	pc2, _, _ := transport.pool.get(contactAddr(&contact2), nil)
+	if pc2 != pc {
+		t.Error("Repeated calls did not reuse the pooled connection")
+	}
+	transport.pool.put(pc2, nil)
+
+	// The pool holds one connection, so talking to instance 3 evicts the
+	// connection to instance 2.
+	instance1.DoPing(contact3.Host, contact3.Port)
+	if len(transport.pool.clients) != 1 {
+		t.Error("Pool grew beyond its maximum size")
+	}
+	if _, ok := transport.pool.clients[contactAddr(&contact2)]; ok {
+		t.Error("Least recently used connection was not evicted")
+	}
+	if !pc.removed {
+		t.Error("Evicted connection was not marked removed")
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	transport := NewPooledHTTPTransport(defaultMaxConns, 10*time.Millisecond)
+	instance1 := NewKademliaWithTransport("localhost:9203", NewRandomID(), transport)
+	instance2 := NewKademlia("localhost:9204")
+	contact2 := instance2.SelfContact
+
+	instance1.DoPing(contact2.Host, contact2.Port)
+	idle := transport.pool.clients[contactAddr(&contact2)]
+	time.Sleep(50 * time.Millisecond)
+	if _, err := instance1.DoPing(contact2.Host, contact2.Port); err != nil {
+		t.Error("Ping after idle timeout failed: ", err)
+	}
+	if !idle.removed {
+		t.Error("Idle connection was not closed")
+	}
+	if transport.pool.clients[contactAddr(&contact2)] == idle {
+		t.Error("Idle connection was reused after its timeout")
+	}
+}
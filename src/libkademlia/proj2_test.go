@@ -52,7 +52,7 @@ func TestIterativeFindNode(t *testing.T) {
 		}
 		result_list_for_sort := make([]ShortListElement, 0, 20)
 		for _, val := range result_list {
-			one_shortlist_element := ShortListElement{val, 159 - search_ID.Xor(val.NodeID).PrefixLen(), 0, false}
+			one_shortlist_element := ShortListElement{val, search_ID.DistanceTo(val.NodeID), 0, false}
 			result_list_for_sort = append(result_list_for_sort, one_shortlist_element)
 		}
 		sort.Sort(ShortListElements(result_list_for_sort))
@@ -0,0 +1,171 @@
+package libkademlia
+
+// Contains the limits on the values a node stores for others, and the
+// eviction of values to make room for new ones.
+
+import (
+	"sort"
+	"time"
+)
+
+// An EvictionPolicy says which values a node drops when a store would take
+// it over MaxStoreBytes.
+type EvictionPolicy int
+
+const (
+	// EvictNone refuses the store instead.
+	EvictNone EvictionPolicy = iota
+	// EvictFarthest drops the values whose keys are farthest from the
+	// node's ID, which nodes closer to those keys are meant to hold. A
+	// value whose key is farther than all of them is refused.
+	EvictFarthest
+	// EvictLRU drops the values least recently stored or looked up.
+	EvictLRU
+)
+
+// storeUsage keeps count of the bytes of value held, in total and per
+// sender. It belongs to whoever holds dataLock.
+type storeUsage struct {
+	total    int64
+	bySender map[ID]int64
+	entries  map[ID]usageEntry
+}
+
+type usageEntry struct {
+	sender   ID
+	size     int64
+	lastUsed time.Time
+}
+
+// newStoreUsage counts the values already held in store.
+func newStoreUsage(store Store) (*storeUsage, error) {
+	u := new(storeUsage)
+	u.bySender = make(map[ID]int64)
+	u.entries = make(map[ID]usageEntry)
+	err := store.Iterate(func(key ID, value StoredValue) bool {
+		u.add(key, value.Sender, int64(len(value.Value)), value.Received)
+		return true
+	})
+	return u, err
+}
+
+func (u *storeUsage) add(key ID, sender ID, size int64, now time.Time) {
+	u.remove(key)
+	u.entries[key] = usageEntry{sender, size, now}
+	u.total += size
+	u.bySender[sender] += size
+}
+
+func (u *storeUsage) remove(key ID) {
+	e, ok := u.entries[key]
+	if !ok {
+		return
+	}
+	delete(u.entries, key)
+	u.total -= e.size
+	if u.bySender[e.sender] -= e.size; u.bySender[e.sender] == 0 {
+		delete(u.bySender, e.sender)
+	}
+}
+
+func (u *storeUsage) touch(key ID, now time.Time) {
+	if e, ok := u.entries[key]; ok {
+		e.lastUsed = now
+		u.entries[key] = e
+	}
+}
+
+// admit decides whether size bytes from sender may be stored under key. It
+// returns the keys to evict first, or a *StoreRefusedError. The caller must
+// hold dataLock.
+func (k *Kademlia) admit(key ID, sender ID, size int64) ([]ID, error) {
+	config := k.config
+	u := k.usage
+	if config.MaxValueSize > 0 && size > int64(config.MaxValueSize) {
+		return nil, &StoreRefusedError{key, "value too large"}
+	}
+	// A value replacing one already held only needs room for the
+	// difference.
+	old := u.entries[key]
+	senderBytes := u.bySender[sender] + size
+	if old.sender == sender {
+		senderBytes -= old.size
+	}
+	if config.MaxSenderBytes > 0 && senderBytes > config.MaxSenderBytes {
+		return nil, &StoreRefusedError{key, "sender over quota"}
+	}
+	if config.MaxStoreBytes == 0 {
+		return nil, nil
+	}
+	excess := u.total - old.size + size - config.MaxStoreBytes
+	if excess <= 0 {
+		return nil, nil
+	}
+	if config.Eviction == EvictNone || size > config.MaxStoreBytes {
+		return nil, &StoreRefusedError{key, "store full"}
+	}
+
+	own := k.NodeID.DistanceTo(key)
+	var candidates []ID
+	for other := range u.entries {
+		if other.Equals(key) {
+			continue
+		}
+		if config.Eviction == EvictFarthest && !own.Less(k.NodeID.DistanceTo(other)) {
+			continue
+		}
+		candidates = append(candidates, other)
+	}
+	if config.Eviction == EvictFarthest {
+		sort.Slice(candidates, func(i, j int) bool {
+			return k.NodeID.DistanceTo(candidates[j]).Less(k.NodeID.DistanceTo(candidates[i]))
+		})
+	} else {
+		sort.Slice(candidates, func(i, j int) bool {
+			return u.entries[candidates[i]].lastUsed.Before(u.entries[candidates[j]].lastUsed)
+		})
+	}
+	var victims []ID
+	for _, victim := range candidates {
+		if excess <= 0 {
+			break
+		}
+		victims = append(victims, victim)
+		excess -= u.entries[victim].size
+	}
+	if excess > 0 {
+		return nil, &StoreRefusedError{key, "store full"}
+	}
+	return victims, nil
+}
+
+// putStored stores pair if the limits allow, evicting values to make room
+// as the eviction policy says. The caller must hold dataLock.
+func (k *Kademlia) putStored(pair *KVPair) error {
+	size := int64(len(pair.value))
+	victims, err := k.admit(pair.key, pair.sender, size)
+	if err != nil {
+		return err
+	}
+	for _, victim := range victims {
+		if err := k.deleteStored(victim); err != nil {
+			return err
+		}
+	}
+	value := StoredValue{pair.value, pair.sender, pair.received, pair.expires}
+	if err := k.store.Put(pair.key, value); err != nil {
+		return err
+	}
+	k.usage.add(pair.key, pair.sender, size, pair.received)
+	return nil
+}
+
+// deleteStored drops the value held under key. The caller must hold
+// dataLock.
+func (k *Kademlia) deleteStored(key ID) error {
+	if err := k.store.Delete(key); err != nil {
+		return err
+	}
+	k.usage.remove(key)
+	return nil
+}
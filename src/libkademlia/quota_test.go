@@ -0,0 +1,139 @@
+package libkademlia
+
+import (
+	"testing"
+)
+
+// newQuotaNode starts a node with the given limits on a simulated network.
+func newQuotaNode(t *testing.T, network *SimNetwork, i int, config Config) *Kademlia {
+	config.Transport = network.Transport()
+	node, err := NewKademliaWithConfig(SimAddress(i), config)
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	return node
+}
+
+func TestStoreLimits(t *testing.T) {
+	network := NewSimNetwork(1)
+	node := newQuotaNode(t, network, 0, Config{MaxValueSize: 10, MaxSenderBytes: 15})
+	defer node.Close()
+	a := newQuotaNode(t, network, 1, Config{})
+	defer a.Close()
+	b := newQuotaNode(t, network, 2, Config{})
+	defer b.Close()
+
+	err := a.DoStore(&node.SelfContact, NewRandomID(), make([]byte, 11))
+	if refused, ok := err.(*StoreRefusedError); !ok {
+		t.Error("Expected StoreRefusedError for a value over MaxValueSize, got ", err)
+	} else if refused.Reason != "value too large" {
+		t.Error("Unexpected reason: ", refused.Reason)
+	}
+
+	key := NewRandomID()
+	if err := a.DoStore(&node.SelfContact, key, make([]byte, 10)); err != nil {
+		t.Fatal("DoStore Return Error: ", err)
+	}
+	if err := a.DoStore(&node.SelfContact, NewRandomID(), make([]byte, 10)); err == nil {
+		t.Error("Store over MaxSenderBytes accepted")
+	}
+	// Replacing a value only counts the difference.
+	if err := a.DoStore(&node.SelfContact, key, make([]byte, 8)); err != nil {
+		t.Error("Replacing a value refused: ", err)
+	}
+	if err := b.DoStore(&node.SelfContact, NewRandomID(), make([]byte, 10)); err != nil {
+		t.Error("Store from another sender refused: ", err)
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	network := NewSimNetwork(1)
+	node := newQuotaNode(t, network, 0, Config{MaxStoreBytes: 30, Eviction: EvictLRU})
+	defer node.Close()
+	other := newQuotaNode(t, network, 1, Config{})
+	defer other.Close()
+
+	keys := []ID{NewRandomID(), NewRandomID(), NewRandomID(), NewRandomID()}
+	for _, key := range keys[:3] {
+		if err := other.DoStore(&node.SelfContact, key, make([]byte, 10)); err != nil {
+			t.Fatal("DoStore Return Error: ", err)
+		}
+	}
+	node.LocalFindValue(keys[0])
+	if err := other.DoStore(&node.SelfContact, keys[3], make([]byte, 10)); err != nil {
+		t.Fatal("Store into a full node not made room for: ", err)
+	}
+	if _, err := node.LocalFindValue(keys[1]); err == nil {
+		t.Error("Least recently used value not evicted")
+	}
+	for _, key := range []ID{keys[0], keys[2], keys[3]} {
+		if _, err := node.LocalFindValue(key); err != nil {
+			t.Error("Recently used value evicted")
+		}
+	}
+}
+
+func TestEvictFarthest(t *testing.T) {
+	network := NewSimNetwork(1)
+	node := newQuotaNode(t, network, 0, Config{MaxStoreBytes: 20, Eviction: EvictFarthest})
+	defer node.Close()
+	other := newQuotaNode(t, network, 1, Config{})
+	defer other.Close()
+
+	// keyAt returns a key whose distance from node has only the given bit
+	// of its first byte set.
+	keyAt := func(bit uint) ID {
+		var distance ID
+		distance[0] = 1 << bit
+		return node.NodeID.Xor(distance)
+	}
+	near, middle, far, farthest := keyAt(1), keyAt(3), keyAt(5), keyAt(7)
+	for _, key := range []ID{middle, far} {
+		if err := other.DoStore(&node.SelfContact, key, make([]byte, 10)); err != nil {
+			t.Fatal("DoStore Return Error: ", err)
+		}
+	}
+	if err := other.DoStore(&node.SelfContact, farthest, make([]byte, 10)); err == nil {
+		t.Error("Value farther than all held accepted into a full node")
+	}
+	if err := other.DoStore(&node.SelfContact, near, make([]byte, 10)); err != nil {
+		t.Fatal("Store of a near value not made room for: ", err)
+	}
+	if _, err := node.LocalFindValue(far); err == nil {
+		t.Error("Farthest value not evicted")
+	}
+	if _, err := node.LocalFindValue(middle); err != nil {
+		t.Error("Nearer value evicted")
+	}
+}
+
+func TestIterativeStoreCountsRefusals(t *testing.T) {
+	network := NewSimNetwork(1)
+	var nodes []*Kademlia
+	for i := 0; i < 6; i++ {
+		config := Config{}
+		if i%2 == 1 {
+			config.MaxValueSize = 4
+		}
+		node := newQuotaNode(t, network, i, config)
+		defer node.Close()
+		if i > 0 {
+			node.Join([]string{SimAddress(0)})
+		}
+		nodes = append(nodes, node)
+	}
+	contacts, err := nodes[0].DoIterativeStore(NewRandomID(), []byte("too long"))
+	if err != nil {
+		t.Fatal("DoIterativeStore Return Error: ", err)
+	}
+	if len(contacts) != 2 {
+		t.Error("Expected 2 nodes to take the value, got ", len(contacts))
+	}
+	for _, c := range contacts {
+		for i, node := range nodes {
+			if i%2 == 1 && node.NodeID.Equals(c.NodeID) {
+				t.Error("Counted a node that refused the value")
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package libkademlia
+
+// Contains the background refresh of k-buckets that have not seen a lookup
+// for a while, as described in section 2.3 of the Kademlia paper.
+
+import (
+	"time"
+)
+
+// touchBucket records a lookup of id as a lookup in the bucket id falls in.
+func (k *Kademlia) touchBucket(id ID) {
+	index := k.FindBucket(id)
+	if index == -1 {
+		return
+	}
+	k.refreshLock.Lock()
+	k.lastLookup[index] = time.Now()
+	k.refreshLock.Unlock()
+}
+
+func (k *Kademlia) touchAllBuckets(now time.Time) {
+	k.refreshLock.Lock()
+	for i := range k.lastLookup {
+		k.lastLookup[i] = now
+	}
+	k.refreshLock.Unlock()
+}
+
+// staleBuckets returns the buckets that have gone without a lookup since
+// before cutoff. Buckets closer to us than the closest one holding any
+// contact are left out; looking up any ID in the closest bucket finds
+// whatever nodes there are nearer to us.
+func (k *Kademlia) staleBuckets(cutoff time.Time) []int {
+	table := k.copyTable()
+	first := 0
+	for first < k.config.IDBits-1 && len(table[first]) == 0 {
+		first++
+	}
+	var stale []int
+	k.refreshLock.Lock()
+	defer k.refreshLock.Unlock()
+	for i := first; i < k.config.IDBits; i++ {
+		if k.lastLookup[i].Before(cutoff) {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// RandomIDInBucket returns a random ID that falls in the given bucket of
+// this node's routing table, i.e. whose distance from NodeID has its highest
+// set bit at position index.
+func (k *Kademlia) RandomIDInBucket(index int) ID {
+	distance := NewRandomIDBits(k.config.IDBits)
+	bit := k.config.IDBits - 1 - index
+	for i := 0; i < bit/8; i++ {
+		distance[i] = 0
+	}
+	mask := uint8(0x80) >> uint(bit%8)
+	distance[bit/8] = (distance[bit/8] & (mask - 1)) | mask
+	return k.NodeID.Xor(distance)
+}
+
+// HandleBucketRefresh looks up a random ID in every bucket that has gone
+// without a lookup for RefreshInterval, until the node is closed. Buckets
+// are checked four times per interval.
+func (k *Kademlia) HandleBucketRefresh() {
+	interval := k.config.RefreshInterval
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-k.ctx.Done():
+			return
+		}
+		for _, index := range k.staleBuckets(time.Now().Add(-interval)) {
+			if k.ctx.Err() != nil {
+				return
+			}
+			k.DoIterativeFindNodeContext(k.ctx, k.RandomIDInBucket(index))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package libkademlia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRandomIDInBucket(t *testing.T) {
+	network := NewSimNetwork(1)
+	instance1, err := NewKademliaWithConfig(SimAddress(0), Config{Transport: network.Transport(), IDBits: 256})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance1.Close()
+	for i := 0; i < 256; i++ {
+		id := instance1.RandomIDInBucket(i)
+		if bucket := instance1.FindBucket(id); bucket != i {
+			t.Error("Random ID for bucket ", i, " falls in bucket ", bucket)
+		}
+	}
+}
+
+func TestBucketRefresh(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 30, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+
+	config := Config{Transport: network.Transport(), RefreshInterval: 100 * time.Millisecond}
+	instance1, err := NewKademliaWithConfig(SimAddress(30), config)
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance1.Close()
+	peer := nodes[0].SelfContact
+	instance1.DoPing(peer.Host, peer.Port)
+	if n := countTableContacts(instance1.copyTable()); n != 1 {
+		t.Fatal("Expected 1 contact before refreshing, got ", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for countTableContacts(instance1.copyTable()) < 10 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := countTableContacts(instance1.copyTable()); n < 10 {
+		t.Error("Refresh found only ", n, " contacts")
+	}
+	if stale := instance1.staleBuckets(time.Now().Add(-time.Second)); len(stale) != 0 {
+		t.Error("Buckets not looked up in the last second: ", stale)
+	}
+}
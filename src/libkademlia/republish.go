@@ -0,0 +1,136 @@
+package libkademlia
+
+// Contains the republishing and replication that keep stored values alive
+// as nodes come and go, as described in section 2.5 of the Kademlia paper.
+
+import (
+	"context"
+	"time"
+)
+
+// A publishedValue is a value this node stored with DoIterativeStore. expires
+// is zero for a value published without a TTL, which is republished until
+// the node is closed. A value published by key is not kept: it is stored
+// under its content ID and fetched again when it is republished.
+type publishedValue struct {
+	value   []byte
+	byKey   bool
+	expires time.Time
+}
+
+// publish takes charge of republishing value under key.
+func (k *Kademlia) publish(key ID, value []byte, ttl time.Duration) {
+	pv := &publishedValue{value: value}
+	if ttl > 0 {
+		pv.expires = time.Now().Add(ttl)
+	}
+	k.publishLock.Lock()
+	k.published[key] = pv
+	k.publishLock.Unlock()
+}
+
+// publishKey takes charge of republishing, without a TTL, the value stored
+// under its content ID key, without keeping the value in memory.
+func (k *Kademlia) publishKey(key ID) {
+	k.publishLock.Lock()
+	k.published[key] = &publishedValue{byKey: true}
+	k.publishLock.Unlock()
+}
+
+// publishedContent fetches a value published by key, from the local store
+// if it holds the value and from the network otherwise.
+func (k *Kademlia) publishedContent(ctx context.Context, key ID) ([]byte, error) {
+	value, ok := k.storedValue(key)
+	if ok && ContentID(value.Value, k.config.IDBits).Equals(key) {
+		return value.Value, nil
+	}
+	return k.DoIterativeFindContentContext(ctx, key)
+}
+
+// republish stores every value this node published again, with what is left
+// of its TTL, and forgets those whose TTL has run out. It returns how many
+// values it republished. A value published by key that can no longer be
+// found is left for the next republish.
+func (k *Kademlia) republish(ctx context.Context, now time.Time) int {
+	published := make(map[ID]*publishedValue)
+	k.publishLock.Lock()
+	for key, pv := range k.published {
+		if !pv.expires.IsZero() && !now.Before(pv.expires) {
+			delete(k.published, key)
+			continue
+		}
+		published[key] = pv
+	}
+	k.publishLock.Unlock()
+
+	republished := 0
+	for key, pv := range published {
+		if ctx.Err() != nil {
+			break
+		}
+		value := pv.value
+		if pv.byKey {
+			var err error
+			if value, err = k.publishedContent(ctx, key); err != nil {
+				continue
+			}
+		}
+		republished++
+		var ttl time.Duration
+		if !pv.expires.IsZero() {
+			ttl = pv.expires.Sub(now)
+		}
+		k.iterativeStore(ctx, key, value, ttl)
+	}
+	return republished
+}
+
+// replicate stores every value this node holds on the K closest nodes to its
+// key, with what is left of its TTL. Values received within the last
+// ReplicateInterval are skipped: whoever sent them has just replicated them.
+// It returns how many values it replicated.
+func (k *Kademlia) replicate(ctx context.Context, now time.Time) int {
+	cutoff := now.Add(-k.config.ReplicateInterval)
+	keys := k.storedKeys(func(value StoredValue) bool {
+		return now.Before(value.Expires) && !value.Received.After(cutoff)
+	})
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		if value, ok := k.storedValue(key); ok {
+			k.iterativeStore(ctx, key, value.Value, value.Expires.Sub(now))
+		}
+	}
+	return len(keys)
+}
+
+// HandleRepublish republishes this node's values every RepublishInterval
+// until the node is closed.
+func (k *Kademlia) HandleRepublish() {
+	ticker := time.NewTicker(k.config.RepublishInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			k.republish(k.ctx, now)
+		case <-k.ctx.Done():
+			return
+		}
+	}
+}
+
+// HandleReplicate replicates the values this node holds every
+// ReplicateInterval until the node is closed.
+func (k *Kademlia) HandleReplicate() {
+	ticker := time.NewTicker(k.config.ReplicateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			k.replicate(k.ctx, now)
+		case <-k.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package libkademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// forgetData drops every value a node holds, as if it had restarted.
+func forgetData(k *Kademlia) {
+	k.dataLock.Lock()
+	k.store = NewMemoryStore()
+	k.usage, _ = newStoreUsage(k.store)
+	k.dataLock.Unlock()
+}
+
+func TestRepublish(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 20, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	key, shortKey := NewRandomID(), NewRandomID()
+	if _, err := nodes[0].DoIterativeStore(key, []byte("value")); err != nil {
+		t.Fatal("DoIterativeStore Return Error: ", err)
+	}
+	if _, err := nodes[0].DoIterativeStoreTTL(shortKey, []byte("short"), 50*time.Millisecond); err != nil {
+		t.Fatal("DoIterativeStoreTTL Return Error: ", err)
+	}
+	for _, node := range nodes {
+		forgetData(node)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	if n := nodes[0].republish(context.Background(), time.Now()); n != 1 {
+		t.Error("Expected 1 value republished, got ", n)
+	}
+	value, err := nodes[10].DoIterativeFindValue(key)
+	if err != nil || string(value) != "value" {
+		t.Error("Republished value not found: ", err)
+	}
+	if _, err := nodes[10].DoIterativeFindValue(shortKey); err == nil {
+		t.Error("Expired value republished")
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 20, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	key := NewRandomID()
+	contacts, err := nodes[0].DoIterativeStore(key, []byte("value"))
+	if err != nil || len(contacts) == 0 {
+		t.Fatal("DoIterativeStore Return Error: ", err)
+	}
+	var holder *Kademlia
+	for _, node := range nodes {
+		if node.NodeID.Equals(contacts[0].NodeID) {
+			holder = node
+		}
+	}
+
+	// Every other holder loses the value, as if it had left and come back.
+	for _, node := range nodes {
+		if node != holder {
+			forgetData(node)
+		}
+	}
+
+	now := time.Now()
+	if n := holder.replicate(context.Background(), now); n != 0 {
+		t.Error("Replicated a value received during the last interval")
+	}
+	if n := holder.replicate(context.Background(), now.Add(holder.config.ReplicateInterval)); n != 1 {
+		t.Error("Expected 1 value replicated, got ", n)
+	}
+	held := 0
+	for _, node := range nodes {
+		if _, err := node.LocalFindValue(key); err == nil {
+			held++
+		}
+	}
+	if held != len(contacts)+1 {
+		t.Error("Expected the value on ", len(contacts)+1, " nodes, found it on ", held)
+	}
+}
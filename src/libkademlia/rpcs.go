@@ -2,10 +2,13 @@ package libkademlia
 
 // Contains definitions mirroring the Kademlia spec. You will need to stick
 // strictly to these to be compatible with the reference implementation and
-// other groups' code.
+// other groups' code. Networks with IDs of up to IDBits bits send them in
+// the form given in wire.go.
 
 import (
+	"encoding/gob"
 	"net"
+	"time"
 )
 
 type KademliaRPC struct {
@@ -45,18 +48,27 @@ func (k *KademliaRPC) Ping(ping PingMessage, pong *PongMessage) error {
 ///////////////////////////////////////////////////////////////////////////////
 // STORE
 ///////////////////////////////////////////////////////////////////////////////
+// TTL is how long the value should be kept. The receiver keeps it for at
+// most its ValueTTL, which is also what a TTL of 0 stands for.
 type StoreRequest struct {
 	Sender Contact
 	MsgID  ID
 	Key    ID
 	Value  []byte
+	TTL    time.Duration
 }
 
+// Err is a *StoreRefusedError if the value was not stored.
 type StoreResult struct {
 	MsgID ID
 	Err   error
 }
 
+func init() {
+	// StoreResult.Err travels as an interface value.
+	gob.Register(&StoreRefusedError{})
+}
+
 func (k *KademliaRPC) Store(req StoreRequest, res *StoreResult) error {
 	// TODO: Implement.
 	//fmt.Println("store reaches here step 3!")
@@ -65,9 +77,22 @@ func (k *KademliaRPC) Store(req StoreRequest, res *StoreResult) error {
 	kvpair := new(KVPair)
 	kvpair.key = req.Key
 	kvpair.value = req.Value
-	k.kademlia.StoreData(kvpair)
-	//fmt.Println("store reaches here step 4!")
+	ttl := k.kademlia.config.ValueTTL
+	if req.TTL > 0 && req.TTL < ttl {
+		ttl = req.TTL
+	}
+	kvpair.received = time.Now()
+	kvpair.expires = kvpair.received.Add(ttl)
+	kvpair.sender = req.Sender.NodeID
 	res.MsgID = CopyID(req.MsgID)
+	if err := k.kademlia.StoreData(kvpair); err != nil {
+		if refused, ok := err.(*StoreRefusedError); ok {
+			res.Err = refused
+			return nil
+		}
+		return err
+	}
+	//fmt.Println("store reaches here step 4!")
 	return nil
 }
 
@@ -110,10 +135,11 @@ type FindValueRequest struct {
 }
 
 // If Value is nil, it should be ignored, and Nodes means the same as in a
-// FindNodeResult.
+// FindNodeResult. TTL is how much longer the value will be kept.
 type FindValueResult struct {
 	MsgID ID
 	Value []byte
+	TTL   time.Duration
 	Nodes []Contact
 	Err   error
 }
@@ -121,7 +147,7 @@ type FindValueResult struct {
 func (k *KademliaRPC) FindValue(req FindValueRequest, res *FindValueResult) error {
 	// TODO: Implement.
 	go k.kademlia.Update(req.Sender)
-	value, err := k.kademlia.LookUpValue(req.Key)
+	pair, err := k.kademlia.lookUpPair(req.Key)
 	if err != nil {
 		//TODO: didn't find value
 		res.MsgID = CopyID(req.MsgID)
@@ -130,7 +156,8 @@ func (k *KademliaRPC) FindValue(req FindValueRequest, res *FindValueResult) erro
 		res.Err = nil
 	} else {
 		res.MsgID = CopyID(req.MsgID)
-		res.Value = value
+		res.Value = pair.value
+		res.TTL = time.Until(pair.expires)
 		res.Nodes = nil
 		res.Err = nil
 	}
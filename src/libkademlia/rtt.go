@@ -0,0 +1,183 @@
+package libkademlia
+
+// Contains the per-peer round-trip time estimates that RPC timeouts are
+// derived from, computed the way TCP computes its retransmission timeout
+// (RFC 6298).
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// Timeout for RPCs to a peer we have no measurements of yet.
+	initialRPCTimeout = time.Second
+	minRPCTimeout     = 100 * time.Millisecond
+	maxRPCTimeout     = 5 * time.Second
+	// An RPC carrying a value gets as much longer as sending the value at
+	// this many bytes per second would take.
+	minRPCBandwidth = 128 << 10
+
+	defaultMaxRTTPeers    = 1024
+	defaultRTTIdleTimeout = 10 * time.Minute
+)
+
+// rttEstimator keeps a smoothed round-trip time and its variance for up to
+// maxPeers of the addresses the node has called, forgetting the least
+// recently measured first. An estimate not updated for idleTimeout is
+// forgotten too, as the path to the peer may have changed since.
+type rttEstimator struct {
+	mu          sync.Mutex
+	peers       map[string]*rttStats
+	maxPeers    int
+	idleTimeout time.Duration
+}
+
+type rttStats struct {
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	lastUsed time.Time
+}
+
+func newRTTEstimator() *rttEstimator {
+	e := new(rttEstimator)
+	e.peers = make(map[string]*rttStats)
+	e.maxPeers = defaultMaxRTTPeers
+	e.idleTimeout = defaultRTTIdleTimeout
+	return e
+}
+
+// timeout returns how long to wait for a reply from addr.
+func (e *rttEstimator) timeout(addr string) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s, ok := e.peers[addr]; ok {
+		if time.Since(s.lastUsed) <= e.idleTimeout {
+			return s.rto
+		}
+		delete(e.peers, addr)
+	}
+	return initialRPCTimeout
+}
+
+// observe records a reply from addr that took rtt.
+func (e *rttEstimator) observe(addr string, rtt time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	s, ok := e.peers[addr]
+	if ok && now.Sub(s.lastUsed) > e.idleTimeout {
+		ok = false
+	}
+	if !ok {
+		s = &rttStats{srtt: rtt, rttvar: rtt / 2, lastUsed: now}
+		e.peers[addr] = s
+		e.evictLocked(now)
+	} else {
+		diff := s.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		s.rttvar = (3*s.rttvar + diff) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	s.rto = clampRPCTimeout(s.srtt + 4*s.rttvar)
+	s.lastUsed = now
+}
+
+// evictLocked forgets idle estimates, then the least recently used ones
+// until no more than maxPeers are left.
+func (e *rttEstimator) evictLocked(now time.Time) {
+	for addr, s := range e.peers {
+		if now.Sub(s.lastUsed) > e.idleTimeout {
+			delete(e.peers, addr)
+		}
+	}
+	for len(e.peers) > e.maxPeers {
+		var oldest string
+		for addr, s := range e.peers {
+			if oldest == "" || s.lastUsed.Before(e.peers[oldest].lastUsed) {
+				oldest = addr
+			}
+		}
+		delete(e.peers, oldest)
+	}
+}
+
+// timedOut doubles the timeout for addr after a call to it timed out.
+func (e *rttEstimator) timedOut(addr string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if s, ok := e.peers[addr]; ok {
+		s.rto = clampRPCTimeout(2 * s.rto)
+		s.lastUsed = time.Now()
+	}
+}
+
+func clampRPCTimeout(d time.Duration) time.Duration {
+	if d < minRPCTimeout {
+		return minRPCTimeout
+	}
+	if d > maxRPCTimeout {
+		return maxRPCTimeout
+	}
+	return d
+}
+
+// payloadSize returns the length of the value a request or reply carries.
+func payloadSize(msg interface{}) int {
+	switch m := msg.(type) {
+	case StoreRequest:
+		return len(m.Value)
+	case *FindValueResult:
+		return len(m.Value)
+	}
+	return 0
+}
+
+// unsizedReply reports whether reply may carry a value whose size the
+// caller cannot know before it arrives.
+func unsizedReply(reply interface{}) bool {
+	_, ok := reply.(*FindValueResult)
+	return ok
+}
+
+// rpcTimeout returns how long to wait for the reply to args from addr: the
+// timeout estimated for the address plus the time it takes to send the
+// value args carries.
+func (k *Kademlia) rpcTimeout(addr string, args interface{}) time.Duration {
+	size := time.Duration(payloadSize(args))
+	return k.rtt.timeout(addr) + size*time.Second/minRPCBandwidth
+}
+
+// timedCall makes an RPC to contact that gives up with an *RPCTimeoutError
+// after rpcTimeout, and updates the estimate for the contact's address. Only
+// calls that carry no value are measured, so the estimate stays that of the
+// round trip itself.
+func (k *Kademlia) timedCall(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	addr := contactAddr(contact)
+	timeout := k.rpcTimeout(addr, args)
+	callCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	wireArgs, wireReply := args, reply
+	if k.shortWireIDs() {
+		wireArgs, wireReply = toWire(args), toWire(reply)
+	}
+	start := time.Now()
+	err := k.transport.Call(callCtx, contact, method, wireArgs, wireReply)
+	if err == nil && wireReply != reply {
+		copyMessage(reply, wireReply)
+	}
+	if err == nil {
+		if payloadSize(args) == 0 && payloadSize(reply) == 0 {
+			k.rtt.observe(addr, time.Since(start))
+		}
+	} else if ctx.Err() == nil && callCtx.Err() == context.DeadlineExceeded {
+		// Our timeout, not the caller's: the peer failed to answer.
+		k.rtt.timedOut(addr)
+		err = &RPCTimeoutError{addr, timeout}
+	}
+	return err
+}
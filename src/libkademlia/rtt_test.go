@@ -0,0 +1,130 @@
+package libkademlia
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	e := newRTTEstimator()
+	if d := e.timeout("a"); d != initialRPCTimeout {
+		t.Error("Expected the initial timeout for an unknown peer, got ", d)
+	}
+	for i := 0; i < 20; i++ {
+		e.observe("a", time.Millisecond)
+	}
+	if d := e.timeout("a"); d != minRPCTimeout {
+		t.Error("Expected the minimum timeout for a fast peer, got ", d)
+	}
+	for i := 0; i < 50; i++ {
+		e.observe("b", 400*time.Millisecond)
+	}
+	d := e.timeout("b")
+	if d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Error("Expected a timeout a little over 400ms for a steady slow peer, got ", d)
+	}
+	e.timedOut("b")
+	if e.timeout("b") != 2*d {
+		t.Error("Timeout not doubled after a timeout")
+	}
+	for i := 0; i < 10; i++ {
+		e.timedOut("b")
+	}
+	if e.timeout("b") != maxRPCTimeout {
+		t.Error("Timeout grew past the maximum")
+	}
+}
+
+func TestRTTEstimatorForgets(t *testing.T) {
+	e := newRTTEstimator()
+	e.maxPeers = 3
+	addrs := []string{"a", "b", "c", "d", "e"}
+	for _, addr := range addrs {
+		e.observe(addr, 400*time.Millisecond)
+	}
+	if len(e.peers) != 3 {
+		t.Error("Expected 3 estimates, got ", len(e.peers))
+	}
+	if e.timeout("a") != initialRPCTimeout {
+		t.Error("Least recently measured peer not forgotten")
+	}
+	if e.timeout("e") == initialRPCTimeout {
+		t.Error("Most recently measured peer forgotten")
+	}
+
+	e.idleTimeout = 10 * time.Millisecond
+	time.Sleep(20 * time.Millisecond)
+	if e.timeout("e") != initialRPCTimeout {
+		t.Error("Idle estimate still in use")
+	}
+	e.observe("f", 400*time.Millisecond)
+	if len(e.peers) != 1 {
+		t.Error("Idle estimates not dropped, ", len(e.peers), " left")
+	}
+}
+
+func TestSlowPeersStayActive(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.Timeout = 2 * time.Second
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	fast := nodes[1].SelfContact
+	nodes[0].DoPing(fast.Host, fast.Port)
+	if d := nodes[0].rtt.timeout(contactAddr(&fast)); d != minRPCTimeout {
+		t.Error("Expected the minimum timeout on a fast network, got ", d)
+	}
+
+	// Every RPC now takes longer than any fixed timeout a fast network would
+	// call for, but lookups still succeed.
+	network.SetLatency(200*time.Millisecond, 0)
+	target := nodes[9]
+	contacts, err := nodes[0].DoIterativeFindNode(target.NodeID)
+	if err != nil {
+		t.Fatal("DoIterativeFindNode Return Error: ", err)
+	}
+	if len(contacts) == 0 || !contacts[0].NodeID.Equals(target.NodeID) {
+		t.Error("DoIterativeFindNode Doesn't Find Search_ID: ", target.NodeID.AsString())
+	}
+}
+
+func TestRPCTimeoutAllowsForValues(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		network := NewSimNetwork(1)
+		network.Timeout = time.Minute
+		nodes := GenerateSimKademlia(network, 2, 1)
+		defer closeAll(nodes)
+		peer := nodes[1].SelfContact
+		addr := contactAddr(&peer)
+		nodes[0].DoPing(peer.Host, peer.Port)
+		if d := nodes[0].rpcTimeout(addr, PingMessage{}); d != minRPCTimeout {
+			t.Error("Expected the minimum timeout for a ping, got ", d)
+		}
+		store := StoreRequest{Value: make([]byte, minRPCBandwidth)}
+		if d := nodes[0].rpcTimeout(addr, store); d != minRPCTimeout+time.Second {
+			t.Error("Expected a second more for a store of ", minRPCBandwidth, " bytes, got ", d)
+		}
+
+		// A reply to FIND_VALUE may carry a value of any size, so its
+		// timeouts do not count against the peer; those of FIND_NODE do.
+		network.SetLatency(5*time.Second, 0)
+		for i := 0; i < staleFailures; i++ {
+			if _, _, err := nodes[0].DoFindValue(&peer, NewRandomID()); err == nil {
+				t.Fatal("FIND_VALUE answered despite the latency")
+			}
+		}
+		if _, err := nodes[0].FindContact(peer.NodeID); err != nil {
+			t.Error("Contact dropped for FIND_VALUE timeouts")
+		}
+		for i := 0; i < staleFailures; i++ {
+			nodes[0].DoFindNode(&peer, NewRandomID())
+		}
+		if _, err := nodes[0].FindContact(peer.NodeID); err == nil {
+			t.Error("Contact kept after FIND_NODE timeouts")
+		}
+	})
+}
@@ -0,0 +1,323 @@
+package libkademlia
+
+// Contains an in-process simulated network. Nodes attached to a SimNetwork
+// exchange RPCs without opening sockets, which lets a single test process run
+// thousands of nodes with controlled latency, loss and partitions.
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SimNetwork routes RPCs between the nodes attached to it. Addresses are
+// virtual: any IP literal and port may be used, and nothing is bound on the
+// host.
+//
+// Whether a message is lost and how much jitter it gets depends only on the
+// seed given to NewSimNetwork, the addresses it goes between and how many
+// messages went that way before it, never on the order goroutines happen to
+// send in. Delays are waited out with the time package, so in a
+// testing/synctest bubble they pass on the bubble's virtual clock: a run
+// takes no real time waiting and is not affected by how busy the machine is.
+// With jitter set, no two messages arrive at the same virtual instant, and a
+// run with the same seed delivers the same messages at the same times.
+type SimNetwork struct {
+	mu        sync.Mutex
+	seed      uint64
+	sent      map[uint64]uint64
+	nodes     map[string]*simNode
+	nextPort  map[string]int
+	latency   time.Duration
+	jitter    time.Duration
+	loss      float64
+	partition map[string]int
+	// Timeout is how long a caller waits before a lost or partitioned
+	// request, or one the remote node takes too long to answer, fails.
+	Timeout time.Duration
+}
+
+func NewSimNetwork(seed int64) *SimNetwork {
+	n := new(SimNetwork)
+	n.seed = uint64(seed)
+	n.sent = make(map[uint64]uint64)
+	n.nodes = make(map[string]*simNode)
+	n.nextPort = make(map[string]int)
+	n.partition = make(map[string]int)
+	n.Timeout = 300 * time.Millisecond
+	return n
+}
+
+// Transport returns a new transport attached to the network. Each node needs
+// its own.
+func (n *SimNetwork) Transport() Transport {
+	return &simTransport{network: n}
+}
+
+// SetLatency sets the one-way delay of every message to latency plus a
+// uniformly random amount up to jitter.
+func (n *SimNetwork) SetLatency(latency, jitter time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = latency
+	n.jitter = jitter
+}
+
+// SetLoss sets the probability, between 0 and 1, that any single request or
+// reply is dropped.
+func (n *SimNetwork) SetLoss(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = rate
+}
+
+// Partition splits the network so that messages only flow between addresses
+// in the same group. Addresses not listed in any group form a group of their
+// own.
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partition = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.partition[addr] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (n *SimNetwork) Heal() {
+	n.Partition()
+}
+
+func (n *SimNetwork) attach(laddr string) (*simAddr, error) {
+	hostname, portstr, err := net.SplitHostPort(laddr)
+	if err != nil {
+		return nil, err
+	}
+	host := net.ParseIP(hostname)
+	if host == nil {
+		return nil, &CommandFailed{"sim: address must be an IP literal: " + laddr}
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if port == 0 {
+		// Hand out ports per host the way an OS hands out ephemeral ports.
+		for port = n.nextPort[host.String()] + 1; ; port++ {
+			if _, ok := n.nodes[(&simAddr{host, port}).String()]; !ok {
+				break
+			}
+		}
+		n.nextPort[host.String()] = port
+	}
+	addr := &simAddr{host, port}
+	if _, ok := n.nodes[addr.String()]; ok {
+		return nil, &CommandFailed{"sim: address already in use: " + addr.String()}
+	}
+	n.nodes[addr.String()] = new(simNode)
+	return addr, nil
+}
+
+// serve starts handing the requests sent to addr to server. Until then the
+// node refuses them.
+func (n *SimNetwork) serve(addr *simAddr, server *rpc.Server) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if node := n.nodes[addr.String()]; node != nil {
+		node.server = server
+	}
+}
+
+// detach stops delivering requests to addr and waits for those already being
+// served there to finish.
+func (n *SimNetwork) detach(addr *simAddr) {
+	n.mu.Lock()
+	node := n.nodes[addr.String()]
+	delete(n.nodes, addr.String())
+	n.mu.Unlock()
+	if node != nil {
+		node.serving.Wait()
+	}
+}
+
+// deliver decides the fate of one message from src to dst. It returns the
+// delay before the message arrives and whether it arrives at all.
+func (n *SimNetwork) deliver(src, dst string) (time.Duration, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s>%s", src, dst)
+	link := h.Sum64()
+	n.sent[link]++
+	lost := simRand(n.seed, link, 2*n.sent[link])
+	jitter := simRand(n.seed, link, 2*n.sent[link]+1)
+	if n.partition[src] != n.partition[dst] || lost < n.loss {
+		return 0, false
+	}
+	return n.latency + time.Duration(jitter*float64(n.jitter)), true
+}
+
+// simRand returns the i'th number in [0, 1) of the pseudo-random sequence
+// that seed and link pick, using the SplitMix64 finalizer.
+func simRand(seed, link, i uint64) float64 {
+	x := (seed ^ link) + i*0x9e3779b97f4a7c15
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11) / (1 << 53)
+}
+
+func (n *SimNetwork) call(ctx context.Context, src string, contact *Contact, method string, args interface{}, reply interface{}) error {
+	dst := contactAddr(contact)
+	n.mu.Lock()
+	node, ok := n.nodes[dst]
+	ok = ok && node.server != nil
+	n.mu.Unlock()
+	if !ok {
+		return &CommandFailed{"sim: connection refused by " + dst}
+	}
+	req, err := encodeMessage(args)
+	if err != nil {
+		return err
+	}
+
+	delay, ok := n.deliver(src, dst)
+	if !ok {
+		return n.timeout(ctx, "sim: request to "+dst+" timed out")
+	}
+	if err := sleepContext(ctx, delay); err != nil {
+		return err
+	}
+	// The node may have gone away while the request was on the wire.
+	n.mu.Lock()
+	node = n.nodes[dst]
+	var server *rpc.Server
+	if node != nil && node.server != nil {
+		server = node.server
+		node.serving.Add(1)
+	}
+	n.mu.Unlock()
+	if server == nil {
+		return &CommandFailed{"sim: connection refused by " + dst}
+	}
+	var res []byte
+	var serveErr error
+	served := make(chan bool, 1)
+	go func() {
+		defer node.serving.Done()
+		res, serveErr = serveRequest(server, method, req)
+		served <- true
+	}()
+	select {
+	case <-served:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(n.Timeout):
+		return &CommandFailed{"sim: request to " + dst + " timed out"}
+	}
+	delay, ok = n.deliver(dst, src)
+	if !ok {
+		return n.timeout(ctx, "sim: reply from "+dst+" timed out")
+	}
+	if err := sleepContext(ctx, delay); err != nil {
+		return err
+	}
+	if serveErr != nil {
+		return serveErr
+	}
+	return decodeMessage(res, reply)
+}
+
+// timeout waits as long as a caller would for a message that never comes.
+func (n *SimNetwork) timeout(ctx context.Context, msg string) error {
+	if err := sleepContext(ctx, n.Timeout); err != nil {
+		return err
+	}
+	return &CommandFailed{msg}
+}
+
+// sleepContext sleeps for d, returning early with ctx.Err() if ctx ends first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type simNode struct {
+	server  *rpc.Server
+	serving sync.WaitGroup
+}
+
+type simTransport struct {
+	network *SimNetwork
+	addr    *simAddr
+}
+
+func (t *simTransport) Listen(laddr string) (net.Addr, error) {
+	addr, err := t.network.attach(laddr)
+	if err != nil {
+		return nil, err
+	}
+	t.addr = addr
+	return addr, nil
+}
+
+func (t *simTransport) Serve(server *rpc.Server) {
+	if t.addr != nil {
+		t.network.serve(t.addr, server)
+	}
+}
+
+func (t *simTransport) Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	src := ""
+	if t.addr != nil {
+		src = t.addr.String()
+	}
+	return t.network.call(ctx, src, contact, method, args, reply)
+}
+
+func (t *simTransport) Close() error {
+	if t.addr != nil {
+		t.network.detach(t.addr)
+	}
+	return nil
+}
+
+// simAddr is the net.Addr of a node attached to a SimNetwork.
+type simAddr struct {
+	host net.IP
+	port int
+}
+
+func (a *simAddr) Network() string {
+	return "sim"
+}
+
+func (a *simAddr) String() string {
+	return net.JoinHostPort(a.host.String(), strconv.Itoa(a.port))
+}
+
+// SimAddress returns the virtual address of the i'th node of a simulated
+// network, for tests that need many distinct addresses.
+func SimAddress(i int) string {
+	i++
+	return fmt.Sprintf("10.%d.%d.%d:7890", (i>>16)&0xff, (i>>8)&0xff, i&0xff)
+}
@@ -0,0 +1,147 @@
+package libkademlia
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// Run e.g. go test -run SimNetwork libkademlia -args -simnodes=500 to look
+// up over a smaller network.
+var simNodes = flag.Int("simnodes", 5000, "number of nodes in simulated network tests")
+
+// GenerateSimKademlia starts num nodes on network, each of which joins
+// through a randomly chosen earlier node and then looks itself up.
+func GenerateSimKademlia(network *SimNetwork, num int, seed int64) []*Kademlia {
+	r := rand.New(rand.NewSource(seed))
+	ResultList := make([]*Kademlia, 0, num)
+	for i := 0; i < num; i++ {
+		var id ID
+		r.Read(id[:IDBytes])
+		instance := NewKademliaWithTransport(SimAddress(i), id, network.Transport())
+		if i > 0 {
+			peer := ResultList[r.Intn(i)].SelfContact
+			instance.DoPing(peer.Host, peer.Port)
+			instance.DoIterativeFindNode(id)
+		}
+		ResultList = append(ResultList, instance)
+	}
+	return ResultList
+}
+
+// closeAll closes every node, ending the goroutines a synctest bubble waits
+// for.
+func closeAll(nodes []*Kademlia) {
+	for _, node := range nodes {
+		node.Close()
+	}
+}
+
+func TestSimNetworkLookup(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		num_nodes := *simNodes
+		network := NewSimNetwork(1)
+		network.SetLatency(10*time.Millisecond, 10*time.Millisecond)
+		nodes := GenerateSimKademlia(network, num_nodes, 1)
+		defer closeAll(nodes)
+		r := rand.New(rand.NewSource(2))
+		for i := 0; i < 50; i++ {
+			from := nodes[r.Intn(num_nodes)]
+			target := nodes[r.Intn(num_nodes)]
+			if from == target {
+				continue
+			}
+			contacts, err := from.DoIterativeFindNode(target.NodeID)
+			if err != nil {
+				t.Error("DoIterativeFindNode Return Error: ", err)
+				continue
+			}
+			found := false
+			for _, c := range contacts {
+				if c.NodeID.Equals(target.NodeID) {
+					found = true
+				}
+			}
+			if !found {
+				t.Error("DoIterativeFindNode Doesn't Find Search_ID: ", target.NodeID.AsString())
+			}
+		}
+	})
+}
+
+// simRun builds a lossy network from seed, runs lookups over it and
+// describes what they found and when, on the virtual clock.
+func simRun(t *testing.T, seed int64) string {
+	var out string
+	synctest.Test(t, func(t *testing.T) {
+		start := time.Now()
+		network := NewSimNetwork(seed)
+		network.SetLatency(10*time.Millisecond, 10*time.Millisecond)
+		network.SetLoss(0.05)
+		nodes := GenerateSimKademlia(network, 100, 1)
+		defer closeAll(nodes)
+		r := rand.New(rand.NewSource(2))
+		for i := 0; i < 20; i++ {
+			from := nodes[r.Intn(len(nodes))]
+			contacts, err := from.DoIterativeFindNode(nodes[r.Intn(len(nodes))].NodeID)
+			out += fmt.Sprintln(i, time.Since(start), err)
+			for _, c := range contacts {
+				out += c.NodeID.AsString() + "\n"
+			}
+		}
+	})
+	return out
+}
+
+func TestSimNetworkDeterministic(t *testing.T) {
+	first := simRun(t, 1)
+	if second := simRun(t, 1); second != first {
+		t.Error("Runs with the same seed differ")
+	}
+	if other := simRun(t, 2); other == first {
+		t.Error("Runs with different seeds are the same")
+	}
+}
+
+func TestSimNetworkLossAndPartition(t *testing.T) {
+	synctest.Test(t, testSimNetworkLossAndPartition)
+}
+
+func testSimNetworkLossAndPartition(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.Timeout = 10 * time.Millisecond
+	instance1 := NewKademliaWithTransport(SimAddress(0), NewRandomID(), network.Transport())
+	instance2 := NewKademliaWithTransport(SimAddress(1), NewRandomID(), network.Transport())
+	defer closeAll([]*Kademlia{instance1, instance2})
+	host2, port2 := instance2.SelfContact.Host, instance2.SelfContact.Port
+	if _, err := instance1.DoPing(host2, port2); err != nil {
+		t.Error("Ping failed on a healthy network: ", err)
+	}
+
+	network.Partition([]string{SimAddress(0)}, []string{SimAddress(1)})
+	if _, err := instance1.DoPing(host2, port2); err == nil {
+		t.Error("Ping crossed a partition")
+	}
+	network.Heal()
+	if _, err := instance1.DoPing(host2, port2); err != nil {
+		t.Error("Ping failed after healing the partition: ", err)
+	}
+
+	network.SetLoss(1)
+	if _, err := instance1.DoPing(host2, port2); err == nil {
+		t.Error("Ping succeeded with every packet dropped")
+	}
+	network.SetLoss(0)
+
+	network.SetLatency(20*time.Millisecond, 0)
+	start := time.Now()
+	if _, err := instance1.DoPing(host2, port2); err != nil {
+		t.Error("Ping failed with latency: ", err)
+	}
+	if elapsed := time.Since(start); elapsed != 40*time.Millisecond {
+		t.Error("Ping took ", elapsed, " on a round-trip latency of 40ms")
+	}
+}
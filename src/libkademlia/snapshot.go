@@ -0,0 +1,171 @@
+package libkademlia
+
+// Contains the on-disk snapshot of a node's ID and routing table, which lets
+// a restarted node rejoin the network through the contacts it had before.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Name of the snapshot file within Config.DataDir.
+const snapshotFile = "routing.json"
+
+// tableSnapshot is the JSON form of a snapshot. IDs are written in hex.
+type tableSnapshot struct {
+	NodeID   string
+	IDBits   int
+	Contacts []snapshotContact
+	// nodeID is NodeID parsed.
+	nodeID ID
+}
+
+type snapshotContact struct {
+	NodeID string
+	Host   string
+	Port   uint16
+}
+
+// loadSnapshot reads the snapshot in dir, which must be of IDs of idBits
+// bits unless idBits is 0. A missing snapshot is not an error; it returns
+// nil.
+func loadSnapshot(dir string, idBits int) (*tableSnapshot, error) {
+	path := filepath.Join(dir, snapshotFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &SnapshotError{path, err}
+	}
+	snapshot := new(tableSnapshot)
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, &SnapshotError{path, err}
+	}
+	// Without its ID, the node would come back as somebody else.
+	snapshot.nodeID, err = IDFromString(snapshot.NodeID)
+	if err == nil && (snapshot.nodeID == (ID{}) || len(snapshot.NodeID) > 2*MaxIDBytes) {
+		err = &CommandFailed{"bad node ID " + strconv.Quote(snapshot.NodeID)}
+	}
+	// Nor can it rejoin a network whose IDs are of another length.
+	if err == nil && (snapshot.IDBits < 8 || snapshot.IDBits > MaxIDBits || snapshot.IDBits%8 != 0) {
+		err = &CommandFailed{fmt.Sprintf("bad IDBits %d", snapshot.IDBits)}
+	} else if err == nil && idBits != 0 && snapshot.IDBits != idBits {
+		err = &CommandFailed{fmt.Sprintf("IDs of %d bits, not %d", snapshot.IDBits, idBits)}
+	}
+	for i := snapshot.IDBits / 8; err == nil && i < MaxIDBytes; i++ {
+		if snapshot.nodeID[i] != 0 {
+			err = &CommandFailed{fmt.Sprintf("node ID %s longer than %d bits", snapshot.NodeID, snapshot.IDBits)}
+		}
+	}
+	if err != nil {
+		return nil, &SnapshotError{path, err}
+	}
+	return snapshot, nil
+}
+
+// contacts returns the contacts of the snapshot, skipping any that do not
+// parse.
+func (snapshot *tableSnapshot) contacts() []Contact {
+	var res []Contact
+	for _, c := range snapshot.Contacts {
+		id, err := IDFromString(c.NodeID)
+		host := net.ParseIP(c.Host)
+		if err != nil || host == nil {
+			continue
+		}
+		res = append(res, Contact{id, host, c.Port})
+	}
+	return res
+}
+
+// SaveSnapshot writes the node's ID and the contents of its k-buckets to
+// its data directory, replacing any earlier snapshot. It does nothing if the
+// node has no data directory.
+func (k *Kademlia) SaveSnapshot() error {
+	if k.config.DataDir == "" {
+		return nil
+	}
+	table := k.copyTable()
+	snapshot := tableSnapshot{NodeID: k.NodeID.AsString(), IDBits: k.config.IDBits}
+	for _, c := range table.GetContacts() {
+		snapshot.Contacts = append(snapshot.Contacts, snapshotContact{c.NodeID.AsString(), c.Host.String(), c.Port})
+	}
+	data, err := json.MarshalIndent(&snapshot, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(k.config.DataDir, snapshotFile)
+	if err := os.MkdirAll(k.config.DataDir, 0755); err != nil {
+		return &SnapshotError{path, err}
+	}
+	// Write a new file and rename it over the old one once it is on disk,
+	// so a crash midway leaves the previous snapshot intact.
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return &SnapshotError{path, err}
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return &SnapshotError{path, err}
+	}
+	return nil
+}
+
+// HandleSnapshot saves a snapshot every SnapshotInterval until the node is
+// closed.
+func (k *Kademlia) HandleSnapshot() {
+	ticker := time.NewTicker(k.config.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			k.SaveSnapshot()
+		case <-k.ctx.Done():
+			return
+		}
+	}
+}
+
+// restoreContacts pings the contacts of a snapshot, up to K at a time, and
+// adds those that answer to the routing table.
+func (k *Kademlia) restoreContacts(contacts []Contact) {
+	var wg sync.WaitGroup
+	limit := make(chan bool, k.config.K)
+	for _, c := range contacts {
+		select {
+		case limit <- true:
+		case <-k.ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			sender, err := k.ping(k.ctx, &c)
+			if err == nil && sender.NodeID.Equals(c.NodeID) {
+				k.Update(sender)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package libkademlia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnapshotWarmRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	network := NewSimNetwork(1)
+	nodes := GenerateSimKademlia(network, 10, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	config := Config{Transport: network.Transport(), DataDir: dir}
+	instance1, err := NewKademliaWithConfig(SimAddress(10), config)
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	for _, node := range nodes {
+		instance1.DoPing(node.SelfContact.Host, node.SelfContact.Port)
+	}
+	id := instance1.NodeID
+	if err := instance1.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+
+	// One of the contacts goes away while the node is down.
+	nodes[0].Close()
+	config.Transport = network.Transport()
+	instance2, err := NewKademliaWithConfig(SimAddress(10), config)
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance2.Close()
+	if !instance2.NodeID.Equals(id) {
+		t.Error("Restarted node has a new ID")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for countTableContacts(instance2.copyTable()) < 9 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	for _, node := range nodes[1:] {
+		if _, err := instance2.FindContact(node.NodeID); err != nil {
+			t.Error("Contact not restored: ", node.NodeID.AsString())
+		}
+	}
+	if _, err := instance2.FindContact(nodes[0].NodeID); err == nil {
+		t.Error("Dead contact restored")
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotFile), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	network := NewSimNetwork(1)
+	config := Config{Transport: network.Transport(), DataDir: dir}
+	if _, err := NewKademliaWithConfig(SimAddress(0), config); err == nil {
+		t.Error("Corrupt snapshot accepted")
+	} else if _, ok := err.(*SnapshotError); !ok {
+		t.Error("Expected SnapshotError, got ", err)
+	}
+
+	// A snapshot whose node ID does not parse must not give the node a new
+	// identity.
+	for _, id := range []string{"not hex", ""} {
+		data := []byte(`{"NodeID": "` + id + `", "IDBits": 160}`)
+		if err := ioutil.WriteFile(filepath.Join(dir, snapshotFile), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewKademliaWithConfig(SimAddress(0), config); err == nil {
+			t.Error("Snapshot with node ID ", strconv.Quote(id), " accepted")
+		} else if _, ok := err.(*SnapshotError); !ok {
+			t.Error("Expected SnapshotError, got ", err)
+		}
+	}
+
+	// Nor may a node come back with IDs of a length other than the one
+	// asked for, or that its own ID does not fit in.
+	id := NewRandomIDBits(256).AsString()
+	for _, c := range []struct {
+		snapshot string
+		idBits   int
+	}{
+		{`{"NodeID": "` + id + `", "IDBits": 256}`, 160},
+		{`{"NodeID": "` + id + `", "IDBits": 160}`, 0},
+		{`{"NodeID": "` + id + `", "IDBits": 0}`, 0},
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, snapshotFile), []byte(c.snapshot), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := Config{Transport: network.Transport(), DataDir: dir, IDBits: c.idBits}
+		if _, err := NewKademliaWithConfig(SimAddress(0), config); err == nil {
+			t.Error("Snapshot ", c.snapshot, " accepted with IDBits ", c.idBits)
+		} else if _, ok := err.(*SnapshotError); !ok {
+			t.Error("Expected SnapshotError, got ", err)
+		}
+	}
+}
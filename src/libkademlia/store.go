@@ -0,0 +1,115 @@
+package libkademlia
+
+// Contains the Store abstraction for the values a node holds for others,
+// along with the default in-memory implementation.
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// valuesFile is the name of the value log kept in a node's data directory.
+const valuesFile = "values.log"
+
+// A StoredValue is a value held under some key, with the node that sent it,
+// when it was received and when it expires.
+type StoredValue struct {
+	Value    []byte
+	Sender   ID
+	Received time.Time
+	Expires  time.Time
+}
+
+// A Store holds the values a node keeps for others. The node serialises its
+// calls, so implementations need not be safe for concurrent use.
+type Store interface {
+	// Get returns the value held under key. ok is false if there is none.
+	Get(key ID) (value StoredValue, ok bool, err error)
+	// Put holds value under key, replacing any value already there.
+	Put(key ID, value StoredValue) error
+	// Delete drops the value held under key, if any.
+	Delete(key ID) error
+	// Iterate calls fn for every key held and its value, in no particular
+	// order, until fn returns false. fn must not modify the store.
+	Iterate(fn func(key ID, value StoredValue) bool) error
+	// Close releases the store.
+	Close() error
+}
+
+// MemoryStore keeps values in a map. They are lost when the node exits.
+type MemoryStore struct {
+	values map[ID]StoredValue
+}
+
+func NewMemoryStore() *MemoryStore {
+	s := new(MemoryStore)
+	s.values = make(map[ID]StoredValue)
+	return s
+}
+
+func (s *MemoryStore) Get(key ID) (StoredValue, bool, error) {
+	value, ok := s.values[key]
+	return value, ok, nil
+}
+
+func (s *MemoryStore) Put(key ID, value StoredValue) error {
+	s.values[key] = value
+	return nil
+}
+
+func (s *MemoryStore) Delete(key ID) error {
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryStore) Iterate(fn func(key ID, value StoredValue) bool) error {
+	for key, value := range s.values {
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// storedKeys returns the keys of the values held that keep returns true for.
+// Only the keys are collected, so the values need not all fit in memory.
+func (k *Kademlia) storedKeys(keep func(value StoredValue) bool) []ID {
+	var keys []ID
+	k.dataLock.Lock()
+	defer k.dataLock.Unlock()
+	k.store.Iterate(func(key ID, value StoredValue) bool {
+		if keep(value) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// storedValue returns the value held under key.
+func (k *Kademlia) storedValue(key ID) (StoredValue, bool) {
+	k.dataLock.Lock()
+	defer k.dataLock.Unlock()
+	value, ok, err := k.store.Get(key)
+	return value, ok && err == nil
+}
+
+// openStore returns the store a node created with config keeps its values
+// in.
+func openStore(config Config) (Store, error) {
+	if config.Store != nil {
+		return config.Store, nil
+	}
+	if config.DataDir == "" {
+		return NewMemoryStore(), nil
+	}
+	if err := os.MkdirAll(config.DataDir, 0755); err != nil {
+		return nil, &StoreError{config.DataDir, err}
+	}
+	return OpenLogStore(filepath.Join(config.DataDir, valuesFile))
+}
@@ -0,0 +1,103 @@
+package libkademlia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStore runs a store through Put, Get, Delete and Iterate.
+func testStore(t *testing.T, s Store) {
+	key1, key2, sender := NewRandomID(), NewRandomID(), NewRandomID()
+	expires := time.Now().Add(time.Hour)
+	if _, ok, err := s.Get(key1); ok || err != nil {
+		t.Error("Get of a missing key returned ", ok, err)
+	}
+	if err := s.Put(key1, StoredValue{[]byte("one"), sender, time.Now(), expires}); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := s.Put(key2, StoredValue{[]byte("two"), sender, time.Now(), expires}); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	if err := s.Put(key1, StoredValue{[]byte("three"), sender, time.Now(), expires}); err != nil {
+		t.Fatal("Put failed: ", err)
+	}
+	value, ok, err := s.Get(key1)
+	if !ok || err != nil || string(value.Value) != "three" {
+		t.Error("Get returned ", string(value.Value), ok, err)
+	}
+	if !value.Expires.Equal(expires) {
+		t.Error("Expiry not kept")
+	}
+	if err := s.Delete(key2); err != nil {
+		t.Fatal("Delete failed: ", err)
+	}
+	if _, ok, _ := s.Get(key2); ok {
+		t.Error("Deleted key still held")
+	}
+	seen := 0
+	s.Iterate(func(key ID, value StoredValue) bool {
+		seen++
+		if !key.Equals(key1) {
+			t.Error("Iterate returned a key not held")
+		}
+		return true
+	})
+	if seen != 1 {
+		t.Error("Expected Iterate to return 1 key, got ", seen)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenLogStore(filepath.Join(dir, valuesFile))
+	if err != nil {
+		t.Fatal("OpenLogStore failed: ", err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestValuesOutliveRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademlia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	network := NewSimNetwork(1)
+	other := GenerateSimKademlia(network, 1, 1)[0]
+	defer other.Close()
+	config := Config{Transport: network.Transport(), DataDir: dir}
+	instance1, err := NewKademliaWithConfig(SimAddress(1), config)
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	key := NewRandomID()
+	if err := other.DoStore(&instance1.SelfContact, key, []byte("value")); err != nil {
+		t.Fatal("DoStore Return Error: ", err)
+	}
+	if err := instance1.Close(); err != nil {
+		t.Fatal("Close failed: ", err)
+	}
+
+	config.Transport = network.Transport()
+	instance2, err := NewKademliaWithConfig(SimAddress(1), config)
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance2.Close()
+	if value, err := instance2.LocalFindValue(key); err != nil || string(value) != "value" {
+		t.Error("Value lost across a restart: ", err)
+	}
+}
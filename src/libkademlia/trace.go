@@ -0,0 +1,95 @@
+package libkademlia
+
+// Contains the records kept of a lookup run in trace mode.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A LookupTrace records every round of a lookup and every RPC it made.
+type LookupTrace struct {
+	Target   ID
+	Rounds   []TraceRound
+	Duration time.Duration
+}
+
+// A TraceRound holds the RPCs a lookup sent out together. Path numbers the
+// disjoint path the round belongs to, from 0.
+type TraceRound struct {
+	Path    int
+	Queries []TraceQuery
+}
+
+// A TraceQuery records one RPC of a lookup. Err is context.Canceled for an
+// RPC that was still outstanding when the lookup ended.
+type TraceQuery struct {
+	Contact  Contact
+	Latency  time.Duration
+	Err      error
+	Contacts []Contact
+	HasValue bool
+}
+
+// record fills in the entry of a round for the RPC that produced res.
+func (round *TraceRound) record(res *lookupResponse) {
+	for i := range round.Queries {
+		q := &round.Queries[i]
+		if q.Contact.NodeID.Equals(res.contact.NodeID) {
+			q.Latency = res.latency
+			q.Err = res.err
+			q.Contacts = res.contacts
+			q.HasValue = res.value != nil
+			return
+		}
+	}
+}
+
+func (trace *LookupTrace) String() string {
+	queries, paths := 0, 1
+	for _, round := range trace.Rounds {
+		queries += len(round.Queries)
+		if round.Path >= paths {
+			paths = round.Path + 1
+		}
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "lookup of %s: %d rounds, %d RPCs, %v\n", trace.Target.AsString(), len(trace.Rounds), queries, trace.Duration)
+	for i, round := range trace.Rounds {
+		if paths > 1 {
+			fmt.Fprintf(&b, "round %d (path %d):\n", i+1, round.Path+1)
+		} else {
+			fmt.Fprintf(&b, "round %d:\n", i+1)
+		}
+		for _, q := range round.Queries {
+			fmt.Fprintf(&b, "  %s %s %v: ", q.Contact.NodeID.AsString(), contactAddr(&q.Contact), q.Latency)
+			switch {
+			case q.Err != nil:
+				fmt.Fprintf(&b, "ERR %s\n", q.Err)
+			case q.HasValue:
+				fmt.Fprintf(&b, "value\n")
+			default:
+				fmt.Fprintf(&b, "%d contacts\n", len(q.Contacts))
+			}
+		}
+	}
+	return b.String()
+}
+
+// DoIterativeFindNodeTrace is DoIterativeFindNodeContext that also returns a
+// trace of the lookup, whether or not it succeeded.
+func (k *Kademlia) DoIterativeFindNodeTrace(ctx context.Context, id ID) ([]Contact, *LookupTrace, error) {
+	trace := &LookupTrace{Target: id}
+	contacts, err := k.iterativeFindNode(ctx, id, trace)
+	return contacts, trace, err
+}
+
+// DoIterativeFindValueTrace is DoIterativeFindValueContext that also
+// returns a trace of the lookup, whether or not it succeeded.
+func (k *Kademlia) DoIterativeFindValueTrace(ctx context.Context, key ID) ([]byte, *LookupTrace, error) {
+	trace := &LookupTrace{Target: key}
+	value, err := k.iterativeFindValue(ctx, key, false, trace)
+	return value, trace, err
+}
@@ -0,0 +1,67 @@
+package libkademlia
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupTrace(t *testing.T) {
+	network := NewSimNetwork(1)
+	network.Timeout = 50 * time.Millisecond
+	nodes := GenerateSimKademlia(network, 30, 1)
+	defer func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	}()
+	key := NewRandomID()
+	if _, err := nodes[1].DoIterativeStore(key, []byte("hello")); err != nil {
+		t.Fatal("DoIterativeStore failed: ", err)
+	}
+
+	value, trace, err := nodes[2].DoIterativeFindValueTrace(context.Background(), key)
+	if err != nil || string(value) != "hello" {
+		t.Fatal("DoIterativeFindValueTrace failed: ", err)
+	}
+	if !trace.Target.Equals(key) || len(trace.Rounds) == 0 || trace.Duration <= 0 {
+		t.Error("Incomplete trace: ", trace)
+	}
+	holders := 0
+	for _, round := range trace.Rounds {
+		for _, q := range round.Queries {
+			if q.HasValue {
+				holders++
+			}
+		}
+	}
+	if holders == 0 {
+		t.Error("Trace does not show who held the value")
+	}
+
+	// A lookup that fails still returns its trace, with the failed RPCs.
+	for _, node := range nodes[3:] {
+		node.Close()
+	}
+	_, trace, err = nodes[2].DoIterativeFindValueTrace(context.Background(), NewRandomID())
+	if err == nil {
+		t.Fatal("Found a value that was never stored")
+	}
+	failed := 0
+	for _, round := range trace.Rounds {
+		for _, q := range round.Queries {
+			if q.Err != nil {
+				failed++
+			} else if len(q.Contacts) == 0 {
+				t.Error("Trace shows no contacts returned by ", q.Contact.NodeID.AsString())
+			}
+		}
+	}
+	if failed == 0 {
+		t.Error("Trace shows no failed RPCs")
+	}
+	if s := trace.String(); !strings.Contains(s, "round 1:") || !strings.Contains(s, "ERR") {
+		t.Error("Unexpected trace text: ", s)
+	}
+}
@@ -0,0 +1,293 @@
+package libkademlia
+
+// Contains the Transport abstraction used for all RPC traffic between nodes,
+// along with the default net/rpc over HTTP implementation.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A Transport carries requests from a Kademlia node to its peers and delivers
+// inbound requests to the node's RPC server. Method names follow net/rpc
+// conventions, e.g. "KademliaRPC.Ping".
+type Transport interface {
+	// Listen binds laddr and returns the address that was actually bound.
+	// No request is handed to the node before Serve is called.
+	Listen(laddr string) (net.Addr, error)
+	// Serve starts handing inbound requests to server.
+	Serve(server *rpc.Server)
+	// Call invokes method on the node described by contact and waits for
+	// the reply, giving up with ctx.Err() once ctx is done.
+	Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error
+	// Close stops accepting requests, waits for those already being served
+	// to finish, and releases the listener and any outbound connections.
+	Close() error
+}
+
+// HTTPTransport speaks net/rpc over HTTP. Each node serves RPCs on
+// rpc.DefaultRPCPath suffixed with its port, so several nodes can share a
+// process. Outbound connections are kept open and reused across calls.
+type HTTPTransport struct {
+	pool *clientPool
+
+	mu       sync.Mutex
+	listener net.Listener
+	server   *rpc.Server
+	path     string
+	http     *http.Server
+	conns    map[net.Conn]bool
+	serving  sync.WaitGroup
+	closed   bool
+}
+
+func NewHTTPTransport() *HTTPTransport {
+	return NewPooledHTTPTransport(defaultMaxConns, defaultConnIdleTimeout)
+}
+
+// NewPooledHTTPTransport creates an HTTPTransport that keeps at most
+// maxConns outbound connections open, closing any left idle for idleTimeout.
+func NewPooledHTTPTransport(maxConns int, idleTimeout time.Duration) *HTTPTransport {
+	t := new(HTTPTransport)
+	t.pool = newClientPool(maxConns, idleTimeout)
+	t.conns = make(map[net.Conn]bool)
+	return t
+}
+
+func (t *HTTPTransport) Listen(laddr string) (net.Addr, error) {
+	l, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	t.listener = l
+	t.path = rpc.DefaultRPCPath + port
+	return l.Addr(), nil
+}
+
+// Serve starts accepting connections. Those made since Listen have been
+// waiting in the listener's backlog.
+func (t *HTTPTransport) Serve(server *rpc.Server) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || t.listener == nil {
+		return
+	}
+	t.server = server
+	t.http = &http.Server{Handler: t}
+	go t.http.Serve(t.listener)
+}
+
+// ServeHTTP accepts the CONNECT request that starts a net/rpc session, the
+// same way rpc.Server.ServeHTTP does, but keeps track of the hijacked
+// connection so Close can drain it.
+func (t *HTTPTransport) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != t.path {
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[conn] = true
+	t.serving.Add(1)
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.conns, conn)
+		t.mu.Unlock()
+		t.serving.Done()
+	}()
+
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	// ServeConn returns once the connection stops delivering requests and
+	// every reply has been written.
+	t.server.ServeConn(conn)
+}
+
+func (t *HTTPTransport) Close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	var err error
+	if t.http != nil {
+		err = t.http.Close()
+	} else if t.listener != nil {
+		err = t.listener.Close()
+	}
+	// Interrupt the read each session is blocked in so it winds down once
+	// its outstanding requests have been answered.
+	for conn := range t.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	t.mu.Unlock()
+
+	t.serving.Wait()
+	t.pool.Close()
+	return err
+}
+
+func (t *HTTPTransport) Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	t.mu.Lock()
+	closed := t.closed
+	t.mu.Unlock()
+	if closed {
+		return errTransportClosed
+	}
+	addr := contactAddr(contact)
+	dial := func() (*rpc.Client, error) {
+		port_str := strconv.Itoa(int(contact.Port))
+		return dialHTTPPath(ctx, addr, rpc.DefaultRPCPath+port_str)
+	}
+	pc, reused, err := t.pool.get(addr, dial)
+	if err != nil {
+		return err
+	}
+	err = callContext(ctx, pc.client, method, args, reply)
+	t.pool.put(pc, err)
+	if reused && staleConn(err) {
+		if pc, _, err = t.pool.get(addr, dial); err != nil {
+			return err
+		}
+		err = callContext(ctx, pc.client, method, args, reply)
+		t.pool.put(pc, err)
+	}
+	return err
+}
+
+// callContext makes a call on client that is abandoned when ctx is done. The
+// connection stays usable; the late reply is discarded by the client.
+func callContext(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dialHTTPPath is rpc.DialHTTPPath with the dial and the HTTP handshake
+// bounded by ctx.
+func dialHTTPPath(ctx context.Context, addr, path string) (*rpc.Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+
+	// Require successful HTTP response before switching to RPC protocol.
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = &CommandFailed{"unexpected HTTP response: " + resp.Status}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+var errTransportClosed = &CommandFailed{"transport closed"}
+
+// contactAddr formats the host:port a contact can be reached at.
+func contactAddr(contact *Contact) string {
+	return net.JoinHostPort(contact.Host.String(), strconv.Itoa(int(contact.Port)))
+}
+
+// serveRequest dispatches a single gob-encoded request to server and returns
+// the gob-encoded reply. It lets transports that do their own framing reuse
+// net/rpc's method dispatch.
+func serveRequest(server *rpc.Server, method string, args []byte) ([]byte, error) {
+	codec := &requestCodec{method: method, args: args}
+	if err := server.ServeRequest(codec); err != nil && codec.err == "" {
+		return nil, err
+	}
+	if codec.err != "" {
+		return nil, rpc.ServerError(codec.err)
+	}
+	return codec.reply, nil
+}
+
+// encodeMessage and decodeMessage gob-encode the request and reply values
+// exchanged by transports that do their own framing.
+func encodeMessage(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMessage(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// requestCodec is an rpc.ServerCodec that holds exactly one request.
+type requestCodec struct {
+	method string
+	args   []byte
+	reply  []byte
+	err    string
+}
+
+func (c *requestCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = c.method
+	r.Seq = 0
+	return nil
+}
+
+func (c *requestCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return decodeMessage(c.args, body)
+}
+
+func (c *requestCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		c.err = r.Error
+		return nil
+	}
+	reply, err := encodeMessage(body)
+	if err != nil {
+		c.err = err.Error()
+		return err
+	}
+	c.reply = reply
+	return nil
+}
+
+func (c *requestCodec) Close() error {
+	return nil
+}
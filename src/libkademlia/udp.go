@@ -0,0 +1,207 @@
+package libkademlia
+
+// Contains a UDP transport following the datagram model of the Kademlia
+// paper. Requests and replies are single datagrams matched up by MsgID;
+// anything too large for a datagram travels over TCP instead.
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest datagram we send. Messages that would not fit go over TCP.
+	maxDatagramSize   = 8192
+	defaultUDPTimeout = 250 * time.Millisecond
+	defaultUDPRetries = 2
+)
+
+// udpPacket frames one request or reply. Body holds the gob-encoded
+// arguments or reply of the RPC named by Method.
+type udpPacket struct {
+	MsgID  ID
+	Reply  bool
+	Method string
+	Body   []byte
+	Err    string
+	// TooLarge is set on a reply that did not fit in a datagram; the caller
+	// should repeat the request over TCP.
+	TooLarge bool
+}
+
+// UDPTransport sends each RPC as a datagram, retransmitting up to Retries
+// times if no reply arrives within Timeout. It also serves net/rpc over HTTP
+// on the same port number for messages too large for a datagram. Kademlia
+// RPCs are idempotent, so a request that is handled twice because its reply
+// was lost does no harm.
+type UDPTransport struct {
+	Timeout time.Duration
+	Retries int
+
+	conn    *net.UDPConn
+	server  *rpc.Server
+	tcp     *HTTPTransport
+	mu      sync.Mutex
+	pending map[ID]chan *udpPacket
+	serving sync.WaitGroup
+	reading sync.WaitGroup
+}
+
+func NewUDPTransport() *UDPTransport {
+	t := new(UDPTransport)
+	t.Timeout = defaultUDPTimeout
+	t.Retries = defaultUDPRetries
+	t.tcp = NewHTTPTransport()
+	t.pending = make(map[ID]chan *udpPacket)
+	return t
+}
+
+func (t *UDPTransport) Listen(laddr string) (net.Addr, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// The TCP fallback listens on whatever port UDP was given.
+	hostname, _, _ := net.SplitHostPort(laddr)
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	if _, err := t.tcp.Listen(net.JoinHostPort(hostname, strconv.Itoa(port))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.conn = conn
+	return conn.LocalAddr(), nil
+}
+
+// Serve starts reading datagrams, along with the TCP fallback. Datagrams
+// that arrived since Listen have been waiting in the socket's buffer.
+func (t *UDPTransport) Serve(server *rpc.Server) {
+	if t.conn == nil {
+		return
+	}
+	t.server = server
+	t.tcp.Serve(server)
+	t.reading.Add(1)
+	go t.readLoop()
+}
+
+// Close stops reading datagrams, waits for the requests already read to be
+// answered and then closes the socket and the TCP fallback.
+func (t *UDPTransport) Close() error {
+	if t.conn != nil {
+		// Unblock the read loop without closing the socket replies still
+		// have to go out on.
+		t.conn.SetReadDeadline(time.Now())
+		t.reading.Wait()
+		t.serving.Wait()
+		t.conn.Close()
+	}
+	return t.tcp.Close()
+}
+
+func (t *UDPTransport) Call(ctx context.Context, contact *Contact, method string, args interface{}, reply interface{}) error {
+	body, err := encodeMessage(args)
+	if err != nil {
+		return err
+	}
+	req := udpPacket{MsgID: NewRandomID(), Method: method, Body: body}
+	data, err := encodeMessage(&req)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxDatagramSize || t.conn == nil {
+		return t.tcp.Call(ctx, contact, method, args, reply)
+	}
+
+	resChan := make(chan *udpPacket, 1)
+	t.mu.Lock()
+	t.pending[req.MsgID] = resChan
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, req.MsgID)
+		t.mu.Unlock()
+	}()
+
+	raddr := &net.UDPAddr{IP: contact.Host, Port: int(contact.Port)}
+	for attempt := 0; attempt <= t.Retries; attempt++ {
+		if _, err := t.conn.WriteToUDP(data, raddr); err != nil {
+			return err
+		}
+		select {
+		case res := <-resChan:
+			if res.TooLarge {
+				return t.tcp.Call(ctx, contact, method, args, reply)
+			}
+			if res.Err != "" {
+				return rpc.ServerError(res.Err)
+			}
+			return decodeMessage(res.Body, reply)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(t.Timeout):
+		}
+	}
+	return &CommandFailed{"udp: request to " + contactAddr(contact) + " timed out"}
+}
+
+func (t *UDPTransport) readLoop() {
+	defer t.reading.Done()
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkt := new(udpPacket)
+		if err := decodeMessage(buf[:n], pkt); err != nil {
+			// Not one of ours; drop it.
+			continue
+		}
+		if pkt.Reply {
+			t.mu.Lock()
+			resChan, ok := t.pending[pkt.MsgID]
+			t.mu.Unlock()
+			if ok {
+				select {
+				case resChan <- pkt:
+				default:
+					// Duplicate reply to a retransmitted request.
+				}
+			}
+			continue
+		}
+		t.serving.Add(1)
+		go t.handle(pkt, from)
+	}
+}
+
+func (t *UDPTransport) handle(req *udpPacket, from *net.UDPAddr) {
+	defer t.serving.Done()
+	res := udpPacket{MsgID: req.MsgID, Reply: true}
+	body, err := serveRequest(t.server, req.Method, req.Body)
+	if err != nil {
+		res.Err = err.Error()
+	} else {
+		res.Body = body
+	}
+	data, err := encodeMessage(&res)
+	if err != nil {
+		return
+	}
+	if len(data) > maxDatagramSize {
+		res.Body = nil
+		res.TooLarge = true
+		if data, err = encodeMessage(&res); err != nil {
+			return
+		}
+	}
+	t.conn.WriteToUDP(data, from)
+}
@@ -0,0 +1,62 @@
+package libkademlia
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestUDPPingAndStore(t *testing.T) {
+	instance1 := NewKademliaWithTransport("localhost:9210", NewRandomID(), NewUDPTransport())
+	instance2 := NewKademliaWithTransport("localhost:9211", NewRandomID(), NewUDPTransport())
+	contact2 := instance2.SelfContact
+	if _, err := instance1.DoPing(contact2.Host, contact2.Port); err != nil {
+		t.Error("UDP ping failed: ", err)
+		return
+	}
+	if _, err := instance2.FindContact(instance1.NodeID); err != nil {
+		t.Error("Instance 1's contact not found in Instance 2's contact list")
+	}
+
+	key := NewRandomID()
+	value := []byte("Hello World")
+	if err := instance1.DoStore(&contact2, key, value); err != nil {
+		t.Error("UDP store failed: ", err)
+	}
+	found, _, err := instance1.DoFindValue(&contact2, key)
+	if err != nil || !bytes.Equal(found, value) {
+		t.Error("UDP find value did not return the stored value")
+	}
+}
+
+func TestUDPLargeValueFallsBackToTCP(t *testing.T) {
+	instance1 := NewKademliaWithTransport("localhost:9212", NewRandomID(), NewUDPTransport())
+	instance2 := NewKademliaWithTransport("localhost:9213", NewRandomID(), NewUDPTransport())
+	contact2 := instance2.SelfContact
+
+	// Too large for the request datagram.
+	key := NewRandomID()
+	value := bytes.Repeat([]byte("x"), 4*maxDatagramSize)
+	if err := instance1.DoStore(&contact2, key, value); err != nil {
+		t.Error("Store of a large value failed: ", err)
+	}
+	// The request fits in a datagram but the reply does not.
+	found, _, err := instance1.DoFindValue(&contact2, key)
+	if err != nil || !bytes.Equal(found, value) {
+		t.Error("Large value was not returned intact: ", err)
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	transport := NewUDPTransport()
+	transport.Timeout = 20 * time.Millisecond
+	instance1 := NewKademliaWithTransport("localhost:9214", NewRandomID(), transport)
+	host, port, _ := StringToIpPort("localhost:9215")
+	start := time.Now()
+	if _, err := instance1.DoPing(host, port); err == nil {
+		t.Error("Ping to a port nobody listens on succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Ping took too long to time out: ", elapsed)
+	}
+}
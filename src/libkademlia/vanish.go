@@ -1,6 +1,7 @@
 package libkademlia
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -83,10 +84,17 @@ func extractKeysFromMap(share_map map[byte][]byte) (ret [][]byte) {
 }
 
 func (k *Kademlia) VanishData(data []byte, numberKeys byte, threshold byte, timeoutSeconds int) (vdo VanashingDataObject) {
+	vdo, _ = k.vanishData(context.Background(), data, numberKeys, threshold, timeoutSeconds)
+	return
+}
+
+func (k *Kademlia) vanishData(ctx context.Context, data []byte, numberKeys byte, threshold byte, timeoutSeconds int) (vdo VanashingDataObject, err error) {
 	key := GenerateRandomCryptoKey()
 	accessKey := GenerateRandomAccessKey()
 	ciphertext := encrypt(key, data)
-	k.ShareKeys(numberKeys, threshold, key, accessKey)
+	if err = k.shareKeys(ctx, numberKeys, threshold, key, accessKey); err != nil {
+		return
+	}
 	vdo.AccessKey = accessKey
 	vdo.Ciphertext = ciphertext
 	vdo.NumberKeys = numberKeys
@@ -122,21 +130,36 @@ func (k *Kademlia) refresh(vdo VanashingDataObject) {
 	}
 }
 func (k *Kademlia) ShareKeys(numberKeys byte, threshold byte, key []byte, accessKey int64) {
+	k.shareKeys(context.Background(), numberKeys, threshold, key, accessKey)
+}
+
+func (k *Kademlia) shareKeys(ctx context.Context, numberKeys byte, threshold byte, key []byte, accessKey int64) error {
 	share_map, err := sss.Split(numberKeys, threshold, key)
 	share_keys := extractKeysFromMap(share_map)
 	if err == nil {
 		location_ids := CalculateSharedKeyLocations(accessKey, (int64)(numberKeys))
 		for i := 0; i < (int)(numberKeys); i++ {
-			k.DoIterativeStore(location_ids[i], share_keys[i])
+			if _, err := k.iterativeStore(ctx, location_ids[i], share_keys[i], 0); err != nil && ctx.Err() != nil {
+				return err
+			}
 		}
 	}
+	return nil
 }
 func (k *Kademlia) UnvanishData(vdo VanashingDataObject) (data []byte) {
+	data, _ = k.unvanishData(context.Background(), vdo)
+	return
+}
+
+func (k *Kademlia) unvanishData(ctx context.Context, vdo VanashingDataObject) (data []byte, err error) {
 	location_ids := CalculateSharedKeyLocations(vdo.AccessKey, (int64)(vdo.NumberKeys))
 	share_map := make(map[byte][]byte)
 	data = nil
 	for _, id := range location_ids {
-		val, _ := k.DoIterativeFindValue(id)
+		val, _ := k.DoIterativeFindValueContext(ctx, id)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		if val != nil {
 			k := val[0]
 			v := val[1:]
@@ -145,9 +168,9 @@ func (k *Kademlia) UnvanishData(vdo VanashingDataObject) (data []byte) {
 	}
 	if len(share_map) < (int)(vdo.Threshold) {
 		fmt.Println("Not Enough Map Items!")
-		return
+		return nil, &CommandFailed{"Not enough key shares to unvanish"}
 	}
 	key := sss.Combine(share_map)
 	data = decrypt(key, vdo.Ciphertext)
-	return
+	return data, nil
 }
@@ -0,0 +1,199 @@
+package libkademlia
+
+// Contains the wire format of the RPCs of networks whose IDs fit in IDBytes.
+// Those exchange IDs as IDBytes-byte arrays, as the original spec did, so
+// that nodes built with 160-bit IDs can still talk to them. Networks with
+// longer IDs send the types in rpcs.go as they are.
+
+import (
+	"net"
+	"reflect"
+	"time"
+)
+
+type wireID [IDBytes]byte
+
+type wireContact struct {
+	NodeID wireID
+	Host   net.IP
+	Port   uint16
+}
+
+// The messages are unnamed struct types so net/rpc accepts them as
+// arguments of wireRPC's methods.
+type wirePingMessage = struct {
+	Sender wireContact
+	MsgID  wireID
+}
+
+type wirePongMessage = struct {
+	MsgID  wireID
+	Sender wireContact
+}
+
+type wireStoreRequest = struct {
+	Sender wireContact
+	MsgID  wireID
+	Key    wireID
+	Value  []byte
+	TTL    time.Duration
+}
+
+type wireStoreResult = struct {
+	MsgID wireID
+	Err   error
+}
+
+type wireFindNodeRequest = struct {
+	Sender wireContact
+	MsgID  wireID
+	NodeID wireID
+}
+
+type wireFindNodeResult = struct {
+	MsgID wireID
+	Nodes []wireContact
+	Err   error
+}
+
+type wireFindValueRequest = struct {
+	Sender wireContact
+	MsgID  wireID
+	Key    wireID
+}
+
+type wireFindValueResult = struct {
+	MsgID wireID
+	Value []byte
+	TTL   time.Duration
+	Nodes []wireContact
+	Err   error
+}
+
+type wireGetVDORequest = struct {
+	Sender wireContact
+	VdoID  wireID
+	MsgID  wireID
+}
+
+type wireGetVDOResult = struct {
+	MsgID wireID
+	VDO   VanashingDataObject
+}
+
+// wireTypes maps each message to its wire form.
+var wireTypes = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(PingMessage{}):      reflect.TypeOf(wirePingMessage{}),
+	reflect.TypeOf(PongMessage{}):      reflect.TypeOf(wirePongMessage{}),
+	reflect.TypeOf(StoreRequest{}):     reflect.TypeOf(wireStoreRequest{}),
+	reflect.TypeOf(StoreResult{}):      reflect.TypeOf(wireStoreResult{}),
+	reflect.TypeOf(FindNodeRequest{}):  reflect.TypeOf(wireFindNodeRequest{}),
+	reflect.TypeOf(FindNodeResult{}):   reflect.TypeOf(wireFindNodeResult{}),
+	reflect.TypeOf(FindValueRequest{}): reflect.TypeOf(wireFindValueRequest{}),
+	reflect.TypeOf(FindValueResult{}):  reflect.TypeOf(wireFindValueResult{}),
+	reflect.TypeOf(GetVDORequest{}):    reflect.TypeOf(wireGetVDORequest{}),
+	reflect.TypeOf(GetVDOResult{}):     reflect.TypeOf(wireGetVDOResult{}),
+}
+
+// shortWireIDs reports whether the node's network exchanges IDs in their
+// wire form.
+func (k *Kademlia) shortWireIDs() bool {
+	return k.config.IDBits <= IDBits
+}
+
+// toWire returns a pointer to the wire form of the message v, or of *v.
+// Values that are not messages are returned as they are.
+func toWire(v interface{}) interface{} {
+	src := reflect.Indirect(reflect.ValueOf(v))
+	wt, ok := wireTypes[src.Type()]
+	if !ok {
+		return v
+	}
+	dst := reflect.New(wt)
+	copyWire(dst.Elem(), src)
+	return dst.Interface()
+}
+
+// copyMessage copies the message src, or *src, into *dst, where one of them
+// is in wire form and the other is not.
+func copyMessage(dst interface{}, src interface{}) {
+	copyWire(reflect.ValueOf(dst).Elem(), reflect.Indirect(reflect.ValueOf(src)))
+}
+
+// copyWire copies src into dst field by field, converting IDs between their
+// full and wire lengths. Bytes of an ID past IDBytes are dropped on the way
+// to the wire, where every ID of the network leaves them zero.
+func copyWire(dst, src reflect.Value) {
+	if dst.Type() == src.Type() {
+		dst.Set(src)
+		return
+	}
+	switch dst.Kind() {
+	case reflect.Array:
+		reflect.Copy(dst, src)
+	case reflect.Struct:
+		for i := 0; i < dst.NumField(); i++ {
+			copyWire(dst.Field(i), src.FieldByName(dst.Type().Field(i).Name))
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeSlice(dst.Type(), src.Len(), src.Len()))
+		for i := 0; i < src.Len(); i++ {
+			copyWire(dst.Index(i), src.Index(i))
+		}
+	default:
+		dst.Set(src)
+	}
+}
+
+// wireRPC serves KademliaRPC to networks that exchange IDs in wire form.
+type wireRPC struct {
+	rpc *KademliaRPC
+}
+
+func (r *wireRPC) Ping(req wirePingMessage, res *wirePongMessage) error {
+	var ping PingMessage
+	var pong PongMessage
+	copyMessage(&ping, req)
+	err := r.rpc.Ping(ping, &pong)
+	copyMessage(res, pong)
+	return err
+}
+
+func (r *wireRPC) Store(req wireStoreRequest, res *wireStoreResult) error {
+	var args StoreRequest
+	var reply StoreResult
+	copyMessage(&args, req)
+	err := r.rpc.Store(args, &reply)
+	copyMessage(res, reply)
+	return err
+}
+
+func (r *wireRPC) FindNode(req wireFindNodeRequest, res *wireFindNodeResult) error {
+	var args FindNodeRequest
+	var reply FindNodeResult
+	copyMessage(&args, req)
+	err := r.rpc.FindNode(args, &reply)
+	copyMessage(res, reply)
+	return err
+}
+
+func (r *wireRPC) FindValue(req wireFindValueRequest, res *wireFindValueResult) error {
+	var args FindValueRequest
+	var reply FindValueResult
+	copyMessage(&args, req)
+	err := r.rpc.FindValue(args, &reply)
+	copyMessage(res, reply)
+	return err
+}
+
+func (r *wireRPC) GetVDO(req wireGetVDORequest, res *wireGetVDOResult) error {
+	var args GetVDORequest
+	var reply GetVDOResult
+	copyMessage(&args, req)
+	err := r.rpc.GetVDO(args, &reply)
+	copyMessage(res, reply)
+	return err
+}
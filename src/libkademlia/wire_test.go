@@ -0,0 +1,106 @@
+package libkademlia
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"strconv"
+	"testing"
+)
+
+// The messages of the original spec, whose IDs were 20-byte arrays.
+type specContact struct {
+	NodeID [20]byte
+	Host   net.IP
+	Port   uint16
+}
+
+type specPing = struct {
+	Sender specContact
+	MsgID  [20]byte
+}
+
+type specPong = struct {
+	MsgID  [20]byte
+	Sender specContact
+}
+
+type specFindNodeRequest = struct {
+	Sender specContact
+	MsgID  [20]byte
+	NodeID [20]byte
+}
+
+type specFindNodeResult = struct {
+	MsgID [20]byte
+	Nodes []specContact
+	Err   error
+}
+
+// specNode answers pings the way a node built from the original spec does.
+type specNode struct {
+	self specContact
+}
+
+func (n *specNode) Ping(ping specPing, pong *specPong) error {
+	pong.MsgID = ping.MsgID
+	pong.Sender = n.self
+	return nil
+}
+
+func TestWireCompatibility(t *testing.T) {
+	instance, err := NewKademliaWithConfig("localhost:9250", Config{})
+	if err != nil {
+		t.Fatal("NewKademliaWithConfig failed: ", err)
+	}
+	defer instance.Close()
+
+	// A node of the original spec calls us.
+	client, err := rpc.DialHTTPPath("tcp", "localhost:9250", rpc.DefaultRPCPath+"9250")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	var self specContact
+	selfID := NewRandomID()
+	copy(self.NodeID[:], selfID[:IDBytes])
+	self.Host = net.IPv4(127, 0, 0, 1)
+	self.Port = 9251
+	ping := specPing{Sender: self, MsgID: [20]byte{1, 2, 3}}
+	var pong specPong
+	if err := client.Call("KademliaRPC.Ping", ping, &pong); err != nil {
+		t.Fatal("Ping in the original format failed: ", err)
+	}
+	if pong.MsgID != ping.MsgID {
+		t.Error("Pong carries the wrong MsgID")
+	}
+	if string(pong.Sender.NodeID[:]) != string(instance.NodeID[:IDBytes]) {
+		t.Error("Pong carries the wrong sender")
+	}
+	var found specFindNodeResult
+	if err := client.Call("KademliaRPC.FindNode", specFindNodeRequest{Sender: self, NodeID: self.NodeID}, &found); err != nil {
+		t.Fatal("FindNode in the original format failed: ", err)
+	}
+
+	// We call a node of the original spec.
+	l, err := net.Listen("tcp", "localhost:9252")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	peerID := NewRandomID()
+	server := rpc.NewServer()
+	peer := &specNode{specContact{Host: net.IPv4(127, 0, 0, 1), Port: 9252}}
+	copy(peer.self.NodeID[:], peerID[:IDBytes])
+	server.RegisterName("KademliaRPC", peer)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath+strconv.Itoa(9252), server)
+	go http.Serve(l, mux)
+	contact, err := instance.DoPing(net.IPv4(127, 0, 0, 1), 9252)
+	if err != nil {
+		t.Fatal("Ping to a node of the original format failed: ", err)
+	}
+	if !contact.NodeID.Equals(peerID) {
+		t.Error("Ping returned the wrong contact")
+	}
+}